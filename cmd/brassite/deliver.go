@@ -0,0 +1,361 @@
+// Copyright 2024 Teknologi Umum <opensource@teknologiumum.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/teknologi-umum/brassite"
+)
+
+// dispatchItem delivers the feed item right away, or holds it until the feed's delivery
+// window opens. Urgent items are always delivered right away.
+func dispatchItem(ctx context.Context, feed brassite.Feed, feedItem brassite.FeedItem) {
+	if feed.DeliveryWindow.IsOpen(time.Now()) || feed.DeliveryWindow.IsUrgent(feedItem) {
+		deliverItem(ctx, feed, feedItem)
+		return
+	}
+
+	slog.DebugContext(ctx, "Holding item until the delivery window opens", slog.String("feed_name", feed.Name), slog.String("item_title", feedItem.ItemTitle))
+
+	err := brassite.HoldItem(stateStore, feed.Name, feedItem)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to hold item, delivering it right away", slog.String("feed_name", feed.Name), slog.Any("error", err))
+		sentry.GetHubFromContext(ctx).CaptureException(err)
+
+		deliverItem(ctx, feed, feedItem)
+	}
+}
+
+// runHeldItems releases the items held by dispatchItem once the delivery window opens.
+func runHeldItems(feed brassite.Feed) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !feed.DeliveryWindow.IsOpen(time.Now()) {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
+		hub := sentry.CurrentHub().Clone()
+		hub.Scope().SetTag("feed_name", feed.Name)
+		ctx = sentry.SetHubOnContext(ctx, hub)
+		ctx = brassite.WithHTTPClient(ctx, deliveryClient)
+
+		items, err := brassite.TakeHeldItems(stateStore, feed.Name)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to take held items", slog.String("feed_name", feed.Name), slog.Any("error", err))
+			sentry.GetHubFromContext(ctx).CaptureException(err)
+		}
+
+		if len(items) > 0 {
+			slog.DebugContext(ctx, "Delivery window opened, releasing held items", slog.String("feed_name", feed.Name), slog.Int("items", len(items)))
+		}
+
+		for _, item := range items {
+			deliverItem(ctx, feed, item)
+		}
+
+		cancel()
+	}
+}
+
+// deliverItem sends the feed item to every delivery target of the route it matches, or of the
+// feed itself. Each delivery is recorded in the outbox first, a failing target is retried later
+// by runOutbox and doesn't stop the item from being sent to the other targets.
+func deliverItem(ctx context.Context, feed brassite.Feed, feedItem brassite.FeedItem) {
+	delivery, _ := feed.Route(feedItem)
+
+	targets := deliveryTargets(delivery)
+
+	if len(targets) == 0 {
+		slog.DebugContext(ctx, "Item doesn't match any route, dropping it", slog.String("feed_name", feed.Name), slog.String("item_title", feedItem.ItemTitle))
+		return
+	}
+
+	for _, target := range targets {
+		// Every digest links to the channel, they'd all be duplicates of the first one.
+		if !brassite.IsDigestItem(feedItem) {
+			duplicate, err := deduplicator.Seen(targetIdentity(delivery, target), feedItem, time.Now())
+			if err != nil {
+				slog.ErrorContext(ctx, "Failed to check for duplicates, delivering anyway", slog.String("feed_name", feed.Name), slog.String("target", target), slog.Any("error", err))
+				sentry.GetHubFromContext(ctx).CaptureException(err)
+			}
+			if duplicate {
+				slog.DebugContext(ctx, "Item was already delivered to this target, skipping", slog.String("feed_name", feed.Name), slog.String("target", target), slog.String("item_url", feedItem.ItemURL))
+				continue
+			}
+		}
+
+		entry, err := outbox.Add(feed.Name, target, feedItem)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to record delivery in the outbox, it won't be retried", slog.String("feed_name", feed.Name), slog.String("target", target), slog.Any("error", err))
+			sentry.GetHubFromContext(ctx).CaptureException(err)
+
+			if err := deliverToTarget(ctx, feed, target, feedItem); err != nil {
+				reportDeliveryError(ctx, feed, target, err)
+			}
+			continue
+		}
+
+		attemptDelivery(ctx, feed, entry)
+	}
+}
+
+// attemptDelivery delivers a single outbox entry and records the result.
+func attemptDelivery(ctx context.Context, feed brassite.Feed, entry brassite.OutboxEntry) {
+	deliveryErr := deliverToTarget(ctx, feed, entry.Target, entry.Item)
+	if deliveryErr == nil {
+		if err := outbox.Succeeded(entry); err != nil {
+			slog.ErrorContext(ctx, "Failed to remove delivered item from the outbox", slog.String("feed_name", feed.Name), slog.String("target", entry.Target), slog.Any("error", err))
+			sentry.GetHubFromContext(ctx).CaptureException(err)
+		}
+		return
+	}
+
+	reportDeliveryError(ctx, feed, entry.Target, deliveryErr)
+
+	deadLettered, err := outbox.Failed(entry, deliveryErr)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to record failed delivery in the outbox", slog.String("feed_name", feed.Name), slog.String("target", entry.Target), slog.Any("error", err))
+		sentry.GetHubFromContext(ctx).CaptureException(err)
+		return
+	}
+
+	if deadLettered {
+		slog.ErrorContext(ctx, "Delivery ran out of attempts, moved to the dead-letter list", slog.String("feed_name", feed.Name), slog.String("target", entry.Target), slog.String("id", entry.ID))
+	}
+}
+
+// runOutbox retries the failed deliveries once their backoff is over.
+func runOutbox(feeds []brassite.Feed) {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		entries, err := outbox.Due(time.Now())
+		if err != nil {
+			slog.Error("Failed to read the outbox", slog.Any("error", err))
+			sentry.CaptureException(err)
+			continue
+		}
+
+		for _, entry := range entries {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
+			hub := sentry.CurrentHub().Clone()
+			hub.Scope().SetTag("feed_name", entry.FeedName)
+			hub.Scope().SetTag("target", entry.Target)
+			ctx = sentry.SetHubOnContext(ctx, hub)
+			ctx = brassite.WithHTTPClient(ctx, deliveryClient)
+
+			slog.DebugContext(ctx, "Retrying delivery", slog.String("feed_name", entry.FeedName), slog.String("target", entry.Target), slog.Int("attempts", entry.Attempts))
+
+			feed, ok := findFeed(feeds, entry.FeedName)
+			if !ok {
+				// The feed was removed from the configuration since, there's nowhere to deliver it.
+				_, err = outbox.Failed(entry, fmt.Errorf("feed %q is no longer configured", entry.FeedName))
+				if err != nil {
+					slog.ErrorContext(ctx, "Failed to record failed delivery in the outbox", slog.String("feed_name", entry.FeedName), slog.Any("error", err))
+				}
+				cancel()
+				continue
+			}
+
+			attemptDelivery(ctx, feed, entry)
+			cancel()
+		}
+	}
+}
+
+func findFeed(feeds []brassite.Feed, name string) (brassite.Feed, bool) {
+	for _, feed := range feeds {
+		if feed.Name == name {
+			return feed, true
+		}
+	}
+	return brassite.Feed{}, false
+}
+
+// deliveryTargets lists the targets of a delivery, e.g. "discord:3f2a9c0d1b7e4a65". They're
+// named after a hash of where they deliver to (see targetIdentity), so the outbox entries keep
+// going to the same place when the configuration is reordered.
+// The names are stored in the outbox, so don't change them.
+func deliveryTargets(delivery brassite.Delivery) []string {
+	identities := targetIdentities(delivery)
+	targets := make([]string, len(identities))
+	for i, identity := range identities {
+		targets[i] = targetName(identity)
+	}
+	return targets
+}
+
+// targetIdentities lists where (and how) each target of the delivery actually delivers to, in
+// the order of deliveryTargets. Two targets only share an identity when delivering through one
+// or the other makes no difference.
+func targetIdentities(delivery brassite.Delivery) []string {
+	var identities []string
+	for _, webhook := range delivery.DiscordWebhookUrl.Values {
+		identities = append(identities, discordIdentity(webhook))
+	}
+	if delivery.Bluesky.Identifier != "" {
+		identities = append(identities, "bluesky:"+delivery.Bluesky.PDSURL+"|"+delivery.Bluesky.Identifier)
+	}
+	if delivery.IRC.Network != "" {
+		identities = append(identities, "irc:"+delivery.IRC.Network+"|"+strings.Join(delivery.IRC.Channels, ","))
+	}
+	if delivery.NATS.Subject != "" {
+		identity := "nats:" + delivery.NATS.URL + "|" + delivery.NATS.Subject
+		if delivery.NATS.JetStream {
+			identity += "|jetstream"
+		}
+		identities = append(identities, identity)
+	}
+	if delivery.Kafka.Topic != "" {
+		identities = append(identities, "kafka:"+strings.Join(delivery.Kafka.Brokers, ",")+"|"+delivery.Kafka.Topic)
+	}
+	if delivery.MQTT.Topic != "" {
+		identities = append(identities, "mqtt:"+delivery.MQTT.Broker+"|"+delivery.MQTT.Topic+"|"+strconv.Itoa(int(delivery.MQTT.QoS))+"|"+strconv.FormatBool(delivery.MQTT.Retain))
+	}
+	if delivery.AMQP.URL != "" {
+		identities = append(identities, "amqp:"+delivery.AMQP.URL+"|"+delivery.AMQP.Exchange+"|"+delivery.AMQP.RoutingKey)
+	}
+	if delivery.File.Path != "" {
+		identities = append(identities, "file:"+delivery.File.Path)
+	}
+	if len(delivery.Exec.Command) > 0 {
+		identities = append(identities, "exec:"+strings.Join(delivery.Exec.Command, " "))
+	}
+
+	// TODO: Feel free to submit a PR and work on this
+	// if delivery.TelegramBotToken != "" && delivery.TelegramChatId != "" {
+	// 	identities = append(identities, "telegram:"+delivery.TelegramChatId)
+	// }
+
+	return identities
+}
+
+// discordIdentity is the webhook and thread, plus the forum post settings when there are some,
+// so webhooks without them keep the identity (and the dedupe history) they always had.
+func discordIdentity(webhook brassite.DiscordWebhook) string {
+	identity := "discord:" + webhook.URL + "#" + webhook.ThreadID
+	if webhook.ThreadName == "" && len(webhook.ForumTags) == 0 {
+		return identity
+	}
+
+	tags := make([]string, 0, len(webhook.ForumTags))
+	for category, tag := range webhook.ForumTags {
+		tags = append(tags, strings.ToLower(category)+"="+tag)
+	}
+	sort.Strings(tags)
+
+	return identity + "|" + webhook.ThreadName + "|" + strings.Join(tags, ",")
+}
+
+// targetName hashes the identity, webhook URLs and such are secrets that don't belong in the
+// outbox or the logs.
+func targetName(identity string) string {
+	kind, _, _ := strings.Cut(identity, ":")
+	sum := sha256.Sum256([]byte(identity))
+	return kind + ":" + hex.EncodeToString(sum[:8])
+}
+
+// targetIdentity identifies where a target actually delivers to, so that feeds sending to
+// the same place (e.g. the same Discord webhook) share their dedupe history.
+func targetIdentity(delivery brassite.Delivery, target string) string {
+	for _, identity := range targetIdentities(delivery) {
+		if targetName(identity) == target {
+			return identity
+		}
+	}
+	return target
+}
+
+// deliverToTarget sends the feed item to a single delivery target of the feed, looked up in the
+// feed's delivery and its routes.
+func deliverToTarget(ctx context.Context, feed brassite.Feed, target string, feedItem brassite.FeedItem) error {
+	deliveries := []brassite.Delivery{feed.Delivery}
+	for _, route := range feed.Routes {
+		deliveries = append(deliveries, route.Delivery)
+	}
+
+	for _, delivery := range deliveries {
+		for i, identity := range targetIdentities(delivery) {
+			if targetName(identity) != target {
+				continue
+			}
+
+			kind, _, _ := strings.Cut(identity, ":")
+			switch kind {
+			case "discord":
+				err := brassite.DeliverToDiscordTracked(ctx, stateStore, feed.OnUpdate, delivery.DiscordWebhookUrl.Values[i], feedItem, feed.Logo, feed.Mentions)
+				var recordErr *brassite.DiscordRecordError
+				if errors.As(err, &recordErr) {
+					// The message is out, retrying would post it twice.
+					slog.WarnContext(ctx, "Failed to record the Discord message, an update will be posted as a new message", slog.String("feed_name", feed.Name), slog.Any("error", err))
+					sentry.GetHubFromContext(ctx).CaptureException(err)
+					return nil
+				}
+				return err
+			case "bluesky":
+				return brassite.DeliverToBluesky(ctx, delivery.Bluesky, feedItem)
+			case "irc":
+				client := ircClients[delivery.IRC.Network]
+				if client == nil {
+					return fmt.Errorf("irc network %q is not configured", delivery.IRC.Network)
+				}
+				return brassite.DeliverToIRC(ctx, client, delivery.IRC.IRCChannels(client.Network()), feedItem)
+			case "nats":
+				return brassite.DeliverToNATS(ctx, delivery.NATS, feedItem)
+			case "kafka":
+				return brassite.DeliverToKafka(ctx, delivery.Kafka, feedItem)
+			case "mqtt":
+				return brassite.DeliverToMQTT(ctx, delivery.MQTT, feedItem)
+			case "amqp":
+				return brassite.DeliverToAMQP(ctx, delivery.AMQP, feedItem)
+			case "file":
+				err := brassite.DeliverToFile(ctx, delivery.File, feedItem)
+				var compressionErr *brassite.FileCompressionError
+				if errors.As(err, &compressionErr) {
+					// The item is in the file, retrying would only write it again.
+					slog.WarnContext(ctx, "Failed to compress rotated files", slog.String("feed_name", feed.Name), slog.String("path", delivery.File.Path), slog.Any("error", err))
+					sentry.GetHubFromContext(ctx).CaptureException(err)
+					return nil
+				}
+				return err
+			case "exec":
+				return brassite.DeliverToExec(ctx, delivery.Exec, feedItem)
+			}
+		}
+	}
+
+	return fmt.Errorf("delivery target %s is no longer configured", target)
+}
+
+func reportDeliveryError(ctx context.Context, feed brassite.Feed, target string, err error) {
+	slog.ErrorContext(ctx, "Failed to deliver", slog.String("feed_name", feed.Name), slog.String("target", target), slog.Any("error", err))
+
+	sentry.GetHubFromContext(ctx).CaptureException(err)
+}
@@ -0,0 +1,65 @@
+// Copyright 2024 Teknologi Umum <opensource@teknologiumum.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/teknologi-umum/brassite"
+)
+
+// runDigest sends the items queued by runWorker as a single summary, on the feed's digest schedule.
+func runDigest(feed brassite.Feed) {
+	for {
+		next, err := feed.Digest.Next(time.Now(), brassite.DigestLastSent(stateStore, feed.Name))
+		if err != nil {
+			slog.Error("Failed to compute next digest time", slog.String("feed_name", feed.Name), slog.Any("error", err))
+			sentry.CaptureException(err)
+			return
+		}
+
+		slog.Debug("Waiting for next digest", slog.String("feed_name", feed.Name), slog.Time("next", next))
+		time.Sleep(time.Until(next))
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
+		hub := sentry.CurrentHub().Clone()
+		hub.Scope().SetTag("feed_name", feed.Name)
+		hub.Scope().SetTag("digest", "true")
+		ctx = sentry.SetHubOnContext(ctx, hub)
+		ctx = brassite.WithHTTPClient(ctx, deliveryClient)
+
+		items, err := brassite.TakeDigest(stateStore, feed.Name, time.Now())
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to take digest items", slog.String("feed_name", feed.Name), slog.Any("error", err))
+			sentry.GetHubFromContext(ctx).CaptureException(err)
+			cancel()
+			// Don't spin on a broken state file.
+			time.Sleep(time.Minute)
+			continue
+		}
+
+		slog.DebugContext(ctx, "Sending digest", slog.String("feed_name", feed.Name), slog.Int("items", len(items)))
+
+		if len(items) > 0 {
+			digest := brassite.BuildDigestItem(feed.Name, items, feed.Digest.MaxItems, time.Now().UTC())
+			dispatchItem(ctx, feed, digest)
+		}
+
+		cancel()
+	}
+}
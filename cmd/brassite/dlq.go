@@ -0,0 +1,121 @@
+// Copyright 2024 Teknologi Umum <opensource@teknologiumum.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/teknologi-umum/brassite"
+)
+
+const dlqUsage = `Usage: brassite dlq <list|retry|purge> --config=<path> [--all] [id...]
+
+  list    List the deliveries that ran out of attempts
+  retry   Move the given dead letters (or all of them with --all) back to the outbox
+  purge   Drop the given dead letters (or all of them with --all) for good
+`
+
+// runDLQCommand implements the `brassite dlq` command, it returns the exit code.
+func runDLQCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, dlqUsage)
+		return 64
+	}
+
+	action := args[0]
+	flags := flag.NewFlagSet("dlq "+action, flag.ContinueOnError)
+	var configFilePath string
+	flags.StringVar(&configFilePath, "config", "", "Path to the configuration file")
+	var all bool
+	flags.BoolVar(&all, "all", false, "Apply to every dead letter")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 64
+	}
+
+	config, err := brassite.ParseConfiguration(configFilePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to parse configuration: %s\n", err)
+		return 69
+	}
+
+	if config.StatePath == "" {
+		fmt.Fprintln(os.Stderr, "state_path is not set in the configuration, the dead-letter list only lives in the memory of the running brassite")
+		return 69
+	}
+
+	store, err := brassite.OpenStateStore(config.StatePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open state file: %s\n", err)
+		return 67
+	}
+
+	deadLetters := brassite.NewOutbox(store, config.Outbox.MaxAttempts)
+
+	entries, err := deadLetters.DeadLetters()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read dead letters: %s\n", err)
+		return 67
+	}
+
+	switch action {
+	case "list":
+		writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(writer, "ID\tFEED\tTARGET\tATTEMPTS\tCREATED\tTITLE\tLAST ERROR")
+		for _, entry := range entries {
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n", entry.ID, entry.FeedName, entry.Target, entry.Attempts, entry.CreatedAt.Local().Format(time.DateTime), entry.Item.ItemTitle, entry.LastError)
+		}
+		_ = writer.Flush()
+		return 0
+
+	case "retry", "purge":
+		ids := flags.Args()
+		if all {
+			ids = ids[:0]
+			for _, entry := range entries {
+				ids = append(ids, entry.ID)
+			}
+		}
+
+		if len(ids) == 0 {
+			fmt.Fprintln(os.Stderr, "Provide the IDs of the dead letters, or --all")
+			return 64
+		}
+
+		exitCode := 0
+		for _, id := range ids {
+			if action == "retry" {
+				err = deadLetters.RetryDeadLetter(id)
+			} else {
+				err = deadLetters.PurgeDeadLetter(id)
+			}
+
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to %s %s: %s\n", action, id, err)
+				exitCode = 1
+				continue
+			}
+
+			fmt.Printf("%s: %s\n", action, id)
+		}
+		return exitCode
+	}
+
+	fmt.Fprint(os.Stderr, dlqUsage)
+	return 64
+}
@@ -0,0 +1,343 @@
+// Copyright 2024 Teknologi Umum <opensource@teknologiumum.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/mmcdole/gofeed"
+	"github.com/mmcdole/gofeed/rss"
+	"github.com/teknologi-umum/brassite"
+)
+
+// fetchResult is the parsed feed, with what the response tells about how to follow it.
+type fetchResult struct {
+	feed *gofeed.Feed
+	// hints are only collected for `interval: auto`
+	hints brassite.PollHints
+	// hub and topic are the WebSub links advertised by the feed, only looked up for feeds with websub
+	hub   string
+	topic string
+}
+
+// fetchFeedWithRetry fetches the feed, retrying transient failures with an exponential backoff
+// (or the server's Retry-After) so a hiccup doesn't cost a whole interval.
+func fetchFeedWithRetry(ctx context.Context, feed brassite.Feed) (fetchResult, error) {
+	maxAttempts := feed.Retry.MaxAttempts()
+	for retry := 0; ; retry++ {
+		result, err := fetchFeed(ctx, feed)
+		if err == nil {
+			return result, nil
+		}
+
+		if retry >= maxAttempts || !brassite.IsRetryableFetchError(err) || ctx.Err() != nil {
+			return fetchResult{}, err
+		}
+
+		backoff := feed.Retry.Backoff(retry + 1)
+		var fetchErr *brassite.FetchError
+		if errors.As(err, &fetchErr) && fetchErr.RetryAfter > 0 {
+			if fetchErr.RetryAfter > feed.Retry.BackoffLimit() {
+				// The server wants us gone for longer than we're willing to wait, try on the next interval.
+				return fetchResult{}, err
+			}
+			backoff = fetchErr.RetryAfter
+		}
+
+		slog.WarnContext(ctx, "Failed to fetch feed, retrying", slog.String("feed_name", feed.Name), slog.Int("retry", retry+1), slog.Duration("backoff", backoff), slog.Any("error", err))
+
+		select {
+		case <-ctx.Done():
+			return fetchResult{}, err
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// fetchFeed fetches and parses the feed once. When the feed URL is a web page, the feed it
+// advertises is discovered and fetched instead, and remembered for the next polls.
+func fetchFeed(ctx context.Context, feed brassite.Feed) (fetchResult, error) {
+	if isExtractedSource(feed) {
+		return extractFeed(ctx, feed)
+	}
+
+	feedURL := feed.URL
+	discoveredURL, discovered := brassite.DiscoveredFeedURL(stateStore, feed.Name, feed.URL)
+	if discovered {
+		feedURL = discoveredURL
+	}
+
+	header, body, err := fetchURL(ctx, sameOriginRequest(feed, feedURL), feedURL)
+	if err != nil {
+		var fetchErr *brassite.FetchError
+		if discovered && errors.As(err, &fetchErr) && fetchErr.StatusCode < 500 {
+			// The site probably moved its feed, look it up again on the next poll.
+			_ = brassite.ForgetDiscoveredFeed(stateStore, feed.Name)
+		}
+		return fetchResult{}, err
+	}
+
+	if brassite.IsHTMLResponse(header.Get("Content-Type"), body) {
+		if discovered {
+			_ = brassite.ForgetDiscoveredFeed(stateStore, feed.Name)
+			return fetchResult{}, fmt.Errorf("discovered feed %s is a web page", feedURL)
+		}
+
+		candidates, err := brassite.DiscoverFeeds(feedURL, body)
+		if err != nil {
+			return fetchResult{}, fmt.Errorf("failed to discover feed: %w", err)
+		}
+
+		candidate, found := brassite.PickFeedCandidate(candidates, feed.PreferFeedType)
+		if !found {
+			return fetchResult{}, fmt.Errorf("%s is a web page that doesn't advertise any feed", feedURL)
+		}
+
+		slog.InfoContext(ctx, "Discovered feed", slog.String("feed_name", feed.Name), slog.String("page_url", feedURL), slog.String("feed_url", candidate.URL), slog.String("type", candidate.Type), slog.Int("candidates", len(candidates)))
+
+		feedURL = candidate.URL
+		header, body, err = fetchURL(ctx, sameOriginRequest(feed, feedURL), feedURL)
+		if err != nil {
+			return fetchResult{}, err
+		}
+
+		if err := brassite.RememberDiscoveredFeed(stateStore, feed.Name, feed.URL, feedURL); err != nil {
+			slog.WarnContext(ctx, "Failed to remember discovered feed", slog.String("feed_name", feed.Name), slog.Any("error", err))
+		}
+	}
+
+	parser := gofeed.NewParser()
+	remoteFeed, err := parser.Parse(bytes.NewReader(body))
+	if err != nil {
+		return fetchResult{}, fmt.Errorf("failed to parse feed: %w", err)
+	}
+
+	brassite.MapPlatformMedia(feed, remoteFeed)
+
+	result := fetchResult{feed: remoteFeed}
+
+	// gofeed drops a few things we may need (RSS ttl and skipHours/skipDays, the rel of
+	// Atom links), the body is parsed again for them.
+	if feed.Interval.Auto {
+		var channel *rss.Feed
+		if remoteFeed.FeedType == "rss" {
+			rssParser := &rss.Parser{}
+			channel, _ = rssParser.Parse(bytes.NewReader(body))
+		}
+		result.hints = brassite.NewPollHints(remoteFeed, channel, header.Get("Cache-Control"))
+	}
+
+	if feed.WebSub {
+		result.hub, result.topic = brassite.DiscoverWebSub(header, body, remoteFeed)
+		if result.hub != "" && result.topic == "" {
+			result.topic = feedURL
+		}
+	}
+
+	return result, nil
+}
+
+// isExtractedSource returns true for the sources that aren't feeds, their items are extracted
+// from a web page or an API response.
+func isExtractedSource(feed brassite.Feed) bool {
+	switch feed.Type {
+	case brassite.SourceTypeScrape, brassite.SourceTypeJSON, brassite.SourceTypeGitHub:
+		return true
+	}
+	return false
+}
+
+// sourceRequest returns the feed to request and the URL of its items. For GitHub repositories,
+// that's the API endpoint, with the API headers added to the feed's own.
+func sourceRequest(feed brassite.Feed) (brassite.Feed, string) {
+	if feed.Type == brassite.SourceTypeGitHub {
+		feed.Headers = feed.GitHub.APIHeaders(feed.Headers)
+		return feed, feed.GitHub.APIURL()
+	}
+	return feed, feed.URL
+}
+
+// extractFeed fetches the page or the API response and extracts its items, for the sources
+// that aren't feeds.
+func extractFeed(ctx context.Context, feed brassite.Feed) (fetchResult, error) {
+	request, sourceURL := sourceRequest(feed)
+	header, body, err := fetchURL(ctx, request, sourceURL)
+	if err != nil {
+		return fetchResult{}, err
+	}
+
+	remoteFeed, warnings, err := parseExtractedFeed(feed, body)
+	if err != nil {
+		return fetchResult{}, err
+	}
+
+	for _, err := range warnings {
+		slog.WarnContext(ctx, "Failed to extract an item", slog.String("feed_name", feed.Name), slog.Any("error", err))
+	}
+
+	if len(remoteFeed.Items) == 0 {
+		// Most likely the page or the API changed and the configuration doesn't match anymore.
+		slog.WarnContext(ctx, "No items found", slog.String("feed_name", feed.Name), slog.String("type", string(feed.Type)))
+	}
+
+	err = brassite.StampFirstSeen(stateStore, feed.Name, remoteFeed.Items, time.Now())
+	if err != nil {
+		return fetchResult{}, fmt.Errorf("failed to track extracted items: %w", err)
+	}
+
+	result := fetchResult{feed: remoteFeed}
+	if feed.Interval.Auto {
+		result.hints = brassite.NewPollHints(remoteFeed, nil, header.Get("Cache-Control"))
+	}
+
+	return result, nil
+}
+
+// parseExtractedFeed extracts the items of the body for `type: scrape`, `json`, or `github`.
+// warnings holds the problems with single items (skipped, or kept without a date), which don't
+// fail the whole source.
+func parseExtractedFeed(feed brassite.Feed, body []byte) (remoteFeed *gofeed.Feed, warnings []error, err error) {
+	switch feed.Type {
+	case brassite.SourceTypeScrape:
+		remoteFeed, warnings, err = brassite.ScrapeFeed(feed.URL, body, feed.Scrape)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to scrape page: %w", err)
+		}
+	case brassite.SourceTypeJSON:
+		remoteFeed, warnings, err = brassite.ExtractJSONFeed(feed.URL, body, feed.JSON)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to extract items: %w", err)
+		}
+	case brassite.SourceTypeGitHub:
+		remoteFeed, err = brassite.ParseGitHubResponse(feed.GitHub, body)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read GitHub response: %w", err)
+		}
+	default:
+		return nil, nil, fmt.Errorf("unknown source type %q", feed.Type)
+	}
+
+	// Pages without a <title> and APIs have no name of their own.
+	if remoteFeed.Title == "" {
+		remoteFeed.Title = feed.Name
+	}
+
+	return remoteFeed, warnings, nil
+}
+
+// sameOriginRequest returns the feed to request targetURL with. The feed's basic auth and
+// headers are meant for feed.URL, they're dropped when the page advertises a feed on another
+// origin, otherwise any page could collect our credentials.
+func sameOriginRequest(feed brassite.Feed, targetURL string) brassite.Feed {
+	if sameOrigin(feed.URL, targetURL) {
+		return feed
+	}
+
+	feed.BasicAuth = brassite.BasicAuth{}
+	feed.Headers = nil
+	return feed
+}
+
+func sameOrigin(a string, b string) bool {
+	urlA, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	urlB, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(urlA.Scheme, urlB.Scheme) && strings.EqualFold(urlA.Host, urlB.Host)
+}
+
+// fetchURL sends the feed's request to url and reads the response.
+func fetchURL(ctx context.Context, feed brassite.Feed, url string) (http.Header, []byte, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	request.Header.Add("Accept", "*/*")
+	request.Header.Add("User-Agent", "Brassite/1.0")
+
+	for key, value := range feed.Headers {
+		request.Header.Set(key, value)
+	}
+
+	if feed.BasicAuth.Username != "" || feed.BasicAuth.Password != "" {
+		request.SetBasicAuth(feed.BasicAuth.Username, feed.BasicAuth.Password)
+	}
+
+	release, err := fetchLimiter.Acquire(ctx, request.URL.Host)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to wait for a fetch slot: %w", err)
+	}
+	defer release()
+
+	response, err := brassite.HTTPClientFromContext(ctx).Do(request)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	// Don't take too long to close the body
+	defer func() {
+		_ = response.Body.Close()
+	}()
+
+	slog.DebugContext(ctx, "Received response", slog.String("feed_name", feed.Name), slog.String("url", url), slog.Int("status_code", response.StatusCode), slog.String("content_type", response.Header.Get("Content-Type")))
+
+	if response.StatusCode >= 400 {
+		return nil, nil, brassite.NewFetchError(response, time.Now())
+	}
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	return response.Header, body, nil
+}
+
+// escalateFailure alerts once the feed failed escalation.After times in a row: an error log,
+// and an alert item sent to the escalation delivery, if there's one.
+func escalateFailure(ctx context.Context, feed brassite.Feed, escalation brassite.EscalationOptions, failures int, err error) {
+	if !escalation.IsEnabled() || failures != escalation.After {
+		return
+	}
+
+	slog.ErrorContext(ctx, "Feed keeps failing", slog.String("feed_name", feed.Name), slog.Int("failures", failures), slog.Any("error", err))
+	sentry.GetHubFromContext(ctx).CaptureMessage(fmt.Sprintf("Feed %s failed %d times in a row", feed.Name, failures))
+
+	if escalation.Delivery.IsEmpty() {
+		return
+	}
+
+	alert := brassite.NewFeedFailureAlert(feed, failures, err, time.Now())
+	alertFeed := brassite.Feed{Name: feed.Name, Delivery: escalation.Delivery}
+	for _, target := range deliveryTargets(escalation.Delivery) {
+		if err := deliverToTarget(ctx, alertFeed, target, alert); err != nil {
+			reportDeliveryError(ctx, alertFeed, "escalation/"+target, err)
+		}
+	}
+}
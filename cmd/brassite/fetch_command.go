@@ -0,0 +1,178 @@
+// Copyright 2024 Teknologi Umum <opensource@teknologiumum.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+	"github.com/teknologi-umum/brassite"
+)
+
+const fetchUsage = `Usage: brassite fetch [--config=<path>] [--prefer=rss|atom|json] <feed name or url>
+
+Fetches a feed once and prints its items. When the URL is a web page, the feeds it
+advertises are listed and the one brassite would pick is fetched. For scraped pages,
+JSON APIs and GitHub repositories, the items extracted by the configuration are printed.
+`
+
+// runFetchCommand implements the `brassite fetch` command, it returns the exit code.
+func runFetchCommand(args []string) int {
+	flags := flag.NewFlagSet("fetch", flag.ContinueOnError)
+	var configFilePath string
+	flags.StringVar(&configFilePath, "config", "", "Path to the configuration file")
+	var prefer string
+	flags.StringVar(&prefer, "prefer", "", "Preferred feed type when the page advertises several feeds")
+	if err := flags.Parse(args); err != nil {
+		return 64
+	}
+
+	if flags.NArg() != 1 {
+		fmt.Fprint(os.Stderr, fetchUsage)
+		return 64
+	}
+
+	target := flags.Arg(0)
+	feed := brassite.Feed{Name: target, URL: target}
+	var httpOptions brassite.HTTPOptions
+	if configFilePath != "" {
+		config, err := brassite.ParseConfiguration(configFilePath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to parse configuration: %s\n", err)
+			return 69
+		}
+
+		httpOptions = config.HTTP
+		for _, configuredFeed := range config.Feeds {
+			if configuredFeed.Name == target || configuredFeed.URL == target {
+				feed = configuredFeed
+				httpOptions = config.HTTP.Merge(configuredFeed.HTTP)
+				break
+			}
+		}
+	}
+
+	request, sourceURL := sourceRequest(feed)
+	if !strings.HasPrefix(sourceURL, "http://") && !strings.HasPrefix(sourceURL, "https://") {
+		fmt.Fprintf(os.Stderr, "%s is neither a configured feed nor an http(s) URL\n", target)
+		return 64
+	}
+
+	if prefer != "" {
+		feed.PreferFeedType = prefer
+	}
+
+	client, err := brassite.NewHTTPClient(httpOptions)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create HTTP client: %s\n", err)
+		return 66
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	ctx = brassite.WithHTTPClient(ctx, client)
+
+	header, body, err := fetchURL(ctx, request, sourceURL)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to fetch %s: %s\n", sourceURL, err)
+		return 1
+	}
+
+	if isExtractedSource(feed) {
+		remoteFeed, warnings, err := parseExtractedFeed(feed, body)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read %s: %s\n", sourceURL, err)
+			return 1
+		}
+
+		for _, err := range warnings {
+			fmt.Fprintf(os.Stderr, "Failed to extract an item: %s\n", err)
+		}
+
+		printFeed(remoteFeed, sourceURL)
+		return 0
+	}
+
+	feedURL := feed.URL
+	if brassite.IsHTMLResponse(header.Get("Content-Type"), body) {
+		candidates, err := brassite.DiscoverFeeds(feed.URL, body)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to discover feeds: %s\n", err)
+			return 1
+		}
+
+		candidate, found := brassite.PickFeedCandidate(candidates, feed.PreferFeedType)
+		if !found {
+			fmt.Fprintf(os.Stderr, "%s is a web page that doesn't advertise any feed\n", feed.URL)
+			return 1
+		}
+
+		writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(writer, "\tTYPE\tTITLE\tURL")
+		for _, c := range candidates {
+			chosen := ""
+			if c == candidate {
+				chosen = "*"
+			}
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\n", chosen, c.Type, c.Title, c.URL)
+		}
+		_ = writer.Flush()
+		fmt.Println()
+
+		feedURL = candidate.URL
+		_, body, err = fetchURL(ctx, sameOriginRequest(feed, feedURL), feedURL)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to fetch %s: %s\n", feedURL, err)
+			return 1
+		}
+	}
+
+	parser := gofeed.NewParser()
+	remoteFeed, err := parser.Parse(bytes.NewReader(body))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to parse %s: %s\n", feedURL, err)
+		return 1
+	}
+
+	brassite.MapPlatformMedia(feed, remoteFeed)
+
+	printFeed(remoteFeed, feedURL)
+	return 0
+}
+
+// printFeed prints the title and the items of the feed.
+func printFeed(remoteFeed *gofeed.Feed, feedURL string) {
+	fmt.Printf("%s (%s, %d items)\n%s\n\n", remoteFeed.Title, remoteFeed.FeedType, len(remoteFeed.Items), feedURL)
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "PUBLISHED\tTITLE\tURL")
+	for _, item := range remoteFeed.Items {
+		published := ""
+		if item.PublishedParsed != nil {
+			published = item.PublishedParsed.Local().Format(time.DateTime)
+		} else if item.UpdatedParsed != nil {
+			published = item.UpdatedParsed.Local().Format(time.DateTime)
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\n", published, strings.Join(strings.Fields(item.Title), " "), item.Link)
+	}
+	_ = writer.Flush()
+}
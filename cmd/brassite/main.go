@@ -21,6 +21,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -33,12 +34,47 @@ import (
 var version string
 var environment = os.Getenv("ENVIRONMENT")
 
+// stateStore remembers what was delivered, shared by every feed.
+var stateStore *brassite.StateStore
+
+// outbox records every delivery until it succeeds, failed ones are retried by runOutbox.
+var outbox *brassite.Outbox
+
+// deduplicator drops items already delivered to the same target, nil when dedupe is disabled.
+var deduplicator *brassite.Deduplicator
+
+// polling spreads the polls over time, fetchLimiter caps how many fetches run at once.
+var (
+	polling      brassite.PollingOptions
+	fetchLimiter *brassite.FetchLimiter
+)
+
+// fetchClients holds the HTTP client each feed is fetched with, keyed by the feed name.
+// Deliveries go through deliveryClient, built from the global HTTP options only.
+var (
+	fetchClients   = make(map[string]*http.Client)
+	deliveryClient *http.Client
+)
+
+// ircClients holds one persistent connection per IRC network, shared by every feed.
+var ircClients = make(map[string]*brassite.IRCClient)
+
 func main() {
 	// This is a very simple program, you can extend this to any extend you'd like.
 	// 1. Read configuration file
 	// 2. For each feed, create a goroutine that will check the feed every `Interval` duration
 	// 3. If there's a new item, send it to the delivery routes
 	// 4. If there's an error, log it
+	if len(os.Args) > 1 && os.Args[1] == "dlq" {
+		os.Exit(runDLQCommand(os.Args[2:]))
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "fetch" {
+		os.Exit(runFetchCommand(os.Args[2:]))
+		return
+	}
+
 	var configFilePath string
 	flag.StringVar(&configFilePath, "config", "", "Path to the configuration file")
 	var sentryDsn string
@@ -103,20 +139,98 @@ func main() {
 	}
 
 	slog.Debug("Configuration is valid")
+
+	stateStore, err = brassite.OpenStateStore(config.StatePath)
+	if err != nil {
+		slog.Error("Failed to open state file", slog.String("path", config.StatePath), slog.Any("error", err))
+		os.Exit(67)
+		return
+	}
+
+	outbox = brassite.NewOutbox(stateStore, config.Outbox.MaxAttempts)
+	if config.Dedupe.IsEnabled() {
+		deduplicator = brassite.NewDeduplicator(stateStore, config.Dedupe)
+	}
+
+	deliveryClient, err = brassite.NewHTTPClient(config.HTTP)
+	if err != nil {
+		slog.Error("Failed to create HTTP client", slog.Any("error", err))
+		os.Exit(66)
+		return
+	}
+
+	for _, feed := range config.Feeds {
+		client, err := brassite.NewHTTPClient(config.HTTP.Merge(feed.HTTP))
+		if err != nil {
+			slog.Error("Failed to create HTTP client", slog.String("feed_name", feed.Name), slog.Any("error", err))
+			os.Exit(66)
+			return
+		}
+		fetchClients[feed.Name] = client
+	}
+
+	polling = config.Polling
+	fetchLimiter = brassite.NewFetchLimiter(config.Polling)
+
 	slog.Info("Starting Brassite")
 
 	exitSignal := make(chan os.Signal, 1)
 	signal.Notify(exitSignal, os.Interrupt, syscall.SIGTERM)
 
+	ircCtx, ircCancel := context.WithCancel(context.Background())
+	for _, network := range config.IRC {
+		client := brassite.NewIRCClient(network)
+		ircClients[network.Name] = client
+		go client.Run(ircCtx, func(err error) {
+			slog.Error("IRC connection failed", slog.String("network", network.Name), slog.Any("error", err))
+			sentry.CaptureException(err)
+		})
+	}
+
+	serverCtx, serverCancel := context.WithCancel(context.Background())
+	if config.Server.Address != "" {
+		mux := http.NewServeMux()
+		if config.Server.PublicURL != "" {
+			webSub = brassite.NewWebSubSubscriber(stateStore, config.Server.PublicURL, handleWebSubContent(config.Feeds))
+			mux.Handle(brassite.WebSubCallbackPath, webSub)
+		}
+		go runServer(serverCtx, config.Server.Address, mux)
+	}
+
+	go runOutbox(config.Feeds)
+
 	for _, feed := range config.Feeds {
-		go runWorker(feed)
+		go runWorker(feed, config.Escalation.Merge(feed.Escalation))
+		if feed.Digest.IsEnabled() {
+			go runDigest(feed)
+		}
+		if feed.DeliveryWindow.IsEnabled() {
+			go runHeldItems(feed)
+		}
 	}
 
 	<-exitSignal
 	slog.Info("Shutting down Brassite")
+	serverCancel()
+	ircCancel()
 }
 
-func runWorker(feed brassite.Feed) {
+func runWorker(feed brassite.Feed, escalation brassite.EscalationOptions) {
+	// Consecutive failed polls, for the escalation
+	failures := 0
+
+	// How long we wait between polls, it only changes with `interval: auto`.
+	interval := feed.Interval.Duration
+	if feed.Interval.Auto {
+		interval, _ = feed.PollIntervalBounds()
+	}
+
+	time.Sleep(polling.StartupDelay())
+
+	// When the previous successful poll happened, new items are the ones published since.
+	// Failed polls don't move it, so the items published meanwhile are picked up on recovery.
+	since := time.Now().UTC().Add(-interval)
+
 	for {
 		ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
 		hub := sentry.CurrentHub().Clone()
@@ -128,125 +242,210 @@ func runWorker(feed brassite.Feed) {
 			"without_content": feed.WithoutContent,
 		})
 		ctx = sentry.SetHubOnContext(ctx, hub)
+		ctx = brassite.WithHTTPClient(ctx, deliveryClient)
 
-		slog.DebugContext(ctx, "Starting worker", slog.String("feed_name", feed.Name), slog.String("url", feed.URL), slog.Duration("interval", feed.Interval))
+		slog.DebugContext(ctx, "Starting worker", slog.String("feed_name", feed.Name), slog.String("url", feed.URL), slog.Duration("interval", interval))
 
-		// Call the feed parser
-		request, err := http.NewRequestWithContext(ctx, http.MethodGet, feed.URL, nil)
-		if err != nil {
-			slog.ErrorContext(ctx, "Failed to create request", slog.Any("error", err), slog.String("feed_name", feed.Name))
+		if feed.WebSub && webSub.IsActive(feed.Name, time.Now()) {
+			// The hub pushes the updates, no need to poll. Polling resumes if the lease runs out.
+			renewWebSub(ctx, feed)
 			cancel()
-			sentry.GetHubFromContext(ctx).CaptureException(err)
-			time.Sleep(feed.Interval)
+			time.Sleep(interval + polling.PollJitter())
 			continue
 		}
 
-		request.Header.Add("Accept", "*/*")
-		request.Header.Add("User-Agent", "Brassite/1.0")
-
-		for key, value := range feed.Headers {
-			request.Header.Add(key, value)
-		}
-
-		if feed.BasicAuth.Username != "" || feed.BasicAuth.Password != "" {
-			request.SetBasicAuth(feed.BasicAuth.Username, feed.BasicAuth.Password)
-		}
-
-		response, err := http.DefaultClient.Do(request)
+		result, err := fetchFeedWithRetry(brassite.WithHTTPClient(ctx, fetchClients[feed.Name]), feed)
+		fetchedAt := time.Now().UTC()
 		if err != nil {
-			slog.ErrorContext(ctx, "Failed to send request", slog.Any("error", err), slog.String("feed_name", feed.Name))
-			cancel()
+			failures++
+			slog.ErrorContext(ctx, "Failed to fetch feed", slog.Any("error", err), slog.String("feed_name", feed.Name), slog.Int("failures", failures))
 			sentry.GetHubFromContext(ctx).CaptureException(err)
-			time.Sleep(feed.Interval)
+			escalateFailure(ctx, feed, escalation, failures, err)
+			cancel()
+			time.Sleep(interval + polling.PollJitter())
 			continue
 		}
 
-		slog.DebugContext(ctx, "Received response", slog.String("feed_name", feed.Name), slog.Int("status_code", response.StatusCode), slog.String("content_type", response.Header.Get("Content-Type")))
+		if escalation.IsEnabled() && failures >= escalation.After {
+			slog.InfoContext(ctx, "Feed recovered", slog.String("feed_name", feed.Name), slog.Int("failures", failures))
+		}
+		failures = 0
 
-		parser := gofeed.NewParser()
-		remoteFeed, err := parser.Parse(response.Body)
-		if err != nil {
-			slog.ErrorContext(ctx, "Failed to parse feed", slog.Any("error", err), slog.String("feed_name", feed.Name))
-			_ = response.Body.Close()
-			cancel()
-			sentry.GetHubFromContext(ctx).CaptureException(err)
-			time.Sleep(feed.Interval)
-			continue
+		if feed.WebSub && result.hub != "" {
+			subscribeWebSub(ctx, feed, result.hub, result.topic)
 		}
 
-		// Don't take too long to close the body
-		_ = response.Body.Close()
+		remoteFeed := result.feed
 
-		// Only select the new items by using now - interval
+		// Only select the items published (or updated) since the previous poll
 		var newItems []*gofeed.Item
 		for _, item := range remoteFeed.Items {
 			slog.DebugContext(ctx, "Parsing item", slog.String("feed_name", feed.Name), slog.String("item_title", item.Title), slog.String("item_link", item.Link))
 
 			if item.PublishedParsed != nil {
-				slog.DebugContext(ctx, "Published parsed value", slog.String("feed_name", feed.Name), slog.Time("published_parsed", *item.PublishedParsed), slog.Time("now", time.Now().UTC()))
-				if item.PublishedParsed.After(time.Now().UTC().Add(-feed.Interval)) {
+				slog.DebugContext(ctx, "Published parsed value", slog.String("feed_name", feed.Name), slog.Time("published_parsed", *item.PublishedParsed), slog.Time("since", since))
+				if item.PublishedParsed.After(since) {
 					newItems = append(newItems, item)
 					continue
 				}
 			}
 
 			if item.UpdatedParsed != nil {
-				slog.DebugContext(ctx, "Updated parsed value", slog.String("feed_name", feed.Name), slog.Time("updated_parsed", *item.UpdatedParsed), slog.Time("now", time.Now().UTC()))
-				if item.UpdatedParsed.After(time.Now().UTC().Add(-feed.Interval)) {
+				slog.DebugContext(ctx, "Updated parsed value", slog.String("feed_name", feed.Name), slog.Time("updated_parsed", *item.UpdatedParsed), slog.Time("since", since))
+				if item.UpdatedParsed.After(since) {
 					newItems = append(newItems, item)
 					continue
 				}
 			}
 		}
 
+		if feed.WebSub {
+			// Share what was seen with the WebSub notifications, so an item is delivered once
+			// whether it was polled or pushed.
+			isNew := make(map[*gofeed.Item]bool, len(newItems))
+			for _, item := range newItems {
+				isNew[item] = true
+			}
+			var oldItems []*gofeed.Item
+			for _, item := range remoteFeed.Items {
+				if !isNew[item] {
+					oldItems = append(oldItems, item)
+				}
+			}
+
+			unseen, err := brassite.FilterUnseenPolledItems(stateStore, feed.Name, newItems, oldItems, time.Now())
+			if err == nil {
+				newItems = unseen
+			} else {
+				slog.ErrorContext(ctx, "Failed to remember seen items", slog.String("feed_name", feed.Name), slog.Any("error", err))
+				sentry.GetHubFromContext(ctx).CaptureException(err)
+			}
+		}
+
 		slog.DebugContext(ctx, "Found new items", slog.String("feed_name", feed.Name), slog.Int("new_items", len(newItems)))
 
-		// Deliver it
-		for _, item := range newItems {
-			var itemDate time.Time
-			if item.PublishedParsed != nil {
-				itemDate = *item.PublishedParsed
+		processItems(ctx, feed, remoteFeed, newItems, fetchedAt)
+
+		if feed.Interval.Auto {
+			var published []time.Time
+			for _, item := range remoteFeed.Items {
+				if item.PublishedParsed != nil {
+					published = append(published, *item.PublishedParsed)
+				} else if item.UpdatedParsed != nil {
+					published = append(published, *item.UpdatedParsed)
+				}
 			}
 
-			feedItem := brassite.FeedItem{
-				ChannelTitle:       remoteFeed.Title,
-				ChannelDescription: remoteFeed.Description,
-				ChannelURL:         remoteFeed.Link,
-				ItemTitle:          item.Title,
-				ItemDescription:    item.Description,
-				ItemDate:           itemDate.Format(time.Stamp),
-				ItemURL:            item.Link,
+			minInterval, maxInterval := feed.PollIntervalBounds()
+			interval = brassite.NextPollInterval(result.hints, published, minInterval, maxInterval, time.Now())
+			slog.DebugContext(ctx, "Picked next poll interval", slog.String("feed_name", feed.Name), slog.Duration("interval", interval))
+		}
+
+		cancel()
+
+		since = fetchedAt
+		time.Sleep(interval + polling.PollJitter())
+	}
+}
+
+// processItems turns the new items of the feed into feed items, runs them through the script
+// and the filters, and delivers them (or adds them to the digest).
+func processItems(ctx context.Context, feed brassite.Feed, remoteFeed *gofeed.Feed, items []*gofeed.Item, fetchedAt time.Time) {
+	for _, item := range items {
+		var itemDate time.Time
+		if item.PublishedParsed != nil {
+			itemDate = *item.PublishedParsed
+		}
+
+		guid := item.GUID
+		if guid == "" {
+			guid = item.Link
+		}
+
+		feedItem := brassite.FeedItem{
+			FeedName:           feed.Name,
+			ChannelTitle:       remoteFeed.Title,
+			ChannelDescription: remoteFeed.Description,
+			ChannelURL:         remoteFeed.Link,
+			ItemTitle:          item.Title,
+			ItemGUID:           guid,
+			ItemDescription:    item.Description,
+			ItemDate:           itemDate.Format(time.Stamp),
+			ItemURL:            item.Link,
+			ItemPublished:      itemDate,
+			FetchedAt:          fetchedAt,
+			ItemImage:          itemImage(item),
+			ItemCategories:     item.Categories,
+			ItemAuthors:        itemAuthors(item),
+		}
+
+		if feed.Script.IsEnabled() {
+			transformed, keep, err := feed.Script.Run(ctx, feedItem)
+			if err != nil {
+				// Only a script returning null drops an item, a buggy one lets it through as is.
+				slog.ErrorContext(ctx, "Failed to run script, delivering the item unchanged", slog.String("feed_name", feed.Name), slog.String("item_title", feedItem.ItemTitle), slog.Any("error", err))
+				sentry.GetHubFromContext(ctx).CaptureException(err)
+				transformed, keep = feedItem, true
+			}
+			if !keep {
+				slog.DebugContext(ctx, "Item dropped by script", slog.String("feed_name", feed.Name), slog.String("item_title", feedItem.ItemTitle))
+				continue
 			}
+			feedItem = transformed
+		}
 
-			if feed.WithoutContent {
-				feedItem.ItemDescription = ""
+		if feed.When != "" {
+			matched, err := brassite.EvaluateItemExpression(feed.When, feedItem)
+			if err != nil {
+				slog.ErrorContext(ctx, "Failed to evaluate when expression, skipping item", slog.String("feed_name", feed.Name), slog.String("item_title", feedItem.ItemTitle), slog.Any("error", err))
+				sentry.GetHubFromContext(ctx).CaptureException(err)
+				continue
 			}
+			if !matched {
+				slog.DebugContext(ctx, "Item filtered out by when expression", slog.String("feed_name", feed.Name), slog.String("item_title", feedItem.ItemTitle))
+				continue
+			}
+		}
 
-			// Deliver to Discord
-			if len(feed.Delivery.DiscordWebhookUrl.Values) > 0 {
-				for _, url := range feed.Delivery.DiscordWebhookUrl.Values {
-					err := brassite.DeliverToDiscord(ctx, url, feedItem, feed.Logo)
-					if err != nil {
-						slog.ErrorContext(ctx, "Failed to deliver to Discord", slog.String("feed_name", feed.Name), slog.Any("error", err))
+		if feed.WithoutContent {
+			feedItem.ItemDescription = ""
+		}
 
-						sentry.GetHubFromContext(ctx).CaptureException(err)
-					}
-				}
+		if feed.Digest.IsEnabled() {
+			err := brassite.AddToDigest(stateStore, feed.Name, feedItem)
+			if err != nil {
+				slog.ErrorContext(ctx, "Failed to queue item for digest", slog.String("feed_name", feed.Name), slog.Any("error", err))
+				sentry.GetHubFromContext(ctx).CaptureException(err)
 			}
+			continue
+		}
+
+		dispatchItem(ctx, feed, feedItem)
+	}
+}
 
-			// TODO: Feel free to submit a PR and work on this
-			// Deliver to Telegram
-			// if feed.Delivery.TelegramBotToken != "" && feed.Delivery.TelegramChatId != "" {
-			// 	err := brassite.DeliverToTelegram(ctx, feed.Delivery.TelegramBotToken, feed.Delivery.TelegramChatId, feedItem)
-			// 	if err != nil {
-			//      slog.Error("Failed to deliver to Telegram", slog.String("feed_name", feed.Name), slog.Any("error", err))
-			// 		sentry.CaptureException(err)
-			// 	}
-			// }
+// itemAuthors lists the author names of the item.
+func itemAuthors(item *gofeed.Item) []string {
+	var authors []string
+	for _, author := range item.Authors {
+		if author != nil && author.Name != "" {
+			authors = append(authors, author.Name)
 		}
+	}
+	return authors
+}
 
-		cancel()
+// itemImage picks the item image, falling back to the first image enclosure.
+func itemImage(item *gofeed.Item) string {
+	if item.Image != nil && item.Image.URL != "" {
+		return item.Image.URL
+	}
 
-		time.Sleep(feed.Interval)
+	for _, enclosure := range item.Enclosures {
+		if enclosure != nil && strings.HasPrefix(enclosure.Type, "image/") {
+			return enclosure.URL
+		}
 	}
+
+	return ""
 }
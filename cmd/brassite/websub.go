@@ -0,0 +1,121 @@
+// Copyright 2024 Teknologi Umum <opensource@teknologiumum.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/mmcdole/gofeed"
+	"github.com/teknologi-umum/brassite"
+)
+
+// webSub receives the pushed updates of feeds with websub, nil when the server is disabled.
+var webSub *brassite.WebSubSubscriber
+
+// runServer runs the built-in HTTP server until ctx is cancelled.
+func runServer(ctx context.Context, address string, handler http.Handler) {
+	server := &http.Server{
+		Addr:              address,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       time.Minute,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+
+	slog.Info("Starting HTTP server", slog.String("address", address))
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("HTTP server failed", slog.String("address", address), slog.Any("error", err))
+		sentry.CaptureException(err)
+	}
+}
+
+// subscribeWebSub subscribes to the hub advertised by the feed, unless we're already
+// subscribed (or waiting for the hub to verify the subscription).
+func subscribeWebSub(ctx context.Context, feed brassite.Feed, hub string, topic string) {
+	if webSub == nil || !webSub.NeedsSubscription(feed.Name, hub, topic, time.Now()) {
+		return
+	}
+
+	slog.InfoContext(ctx, "Subscribing to WebSub hub", slog.String("feed_name", feed.Name), slog.String("hub", hub), slog.String("topic", topic))
+
+	if err := webSub.Subscribe(ctx, feed.Name, hub, topic); err != nil {
+		slog.ErrorContext(ctx, "Failed to subscribe to WebSub hub, polling the feed instead", slog.String("feed_name", feed.Name), slog.String("hub", hub), slog.Any("error", err))
+		sentry.GetHubFromContext(ctx).CaptureException(err)
+	}
+}
+
+// renewWebSub renews the subscription before its lease runs out.
+func renewWebSub(ctx context.Context, feed brassite.Feed) {
+	subscription, ok := webSub.Subscription(feed.Name)
+	if !ok {
+		return
+	}
+
+	subscribeWebSub(ctx, feed, subscription.Hub, subscription.Topic)
+}
+
+// handleWebSubContent runs the content pushed by the hub through the same pipeline as a poll.
+// Many hubs push the whole feed, only the items that weren't seen before (or were updated) go through.
+func handleWebSubContent(feeds []brassite.Feed) func(feedName string, contentType string, body []byte) {
+	return func(feedName string, contentType string, body []byte) {
+		feed, ok := findFeed(feeds, feedName)
+		if !ok {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
+		defer cancel()
+		hub := sentry.CurrentHub().Clone()
+		hub.Scope().SetTag("feed_name", feed.Name)
+		hub.Scope().SetTag("websub", "true")
+		ctx = sentry.SetHubOnContext(ctx, hub)
+		ctx = brassite.WithHTTPClient(ctx, deliveryClient)
+
+		slog.DebugContext(ctx, "Received WebSub notification", slog.String("feed_name", feed.Name), slog.String("content_type", contentType), slog.Int("size", len(body)))
+
+		parser := gofeed.NewParser()
+		remoteFeed, err := parser.Parse(bytes.NewReader(body))
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to parse WebSub notification", slog.String("feed_name", feed.Name), slog.Any("error", err))
+			sentry.GetHubFromContext(ctx).CaptureException(err)
+			return
+		}
+
+		brassite.MapPlatformMedia(feed, remoteFeed)
+
+		items, err := brassite.FilterUnseenItems(stateStore, feed.Name, remoteFeed.Items, time.Now())
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to filter seen items", slog.String("feed_name", feed.Name), slog.Any("error", err))
+			sentry.GetHubFromContext(ctx).CaptureException(err)
+			return
+		}
+
+		slog.DebugContext(ctx, "Found new items", slog.String("feed_name", feed.Name), slog.Int("new_items", len(items)))
+
+		processItems(ctx, feed, remoteFeed, items, time.Now().UTC())
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright 2024 Teknologi Umum <opensource@teknologiumum.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package brassite
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const dedupeBucket = "dedupe"
+
+// Query parameters that only track where the click came from, they're dropped from the URL
+// before comparing. Parameters starting with "utm_" are dropped as well.
+var trackingParameters = map[string]struct{}{
+	"fbclid":        {},
+	"gclid":         {},
+	"dclid":         {},
+	"msclkid":       {},
+	"yclid":         {},
+	"igshid":        {},
+	"mc_cid":        {},
+	"mc_eid":        {},
+	"_hsenc":        {},
+	"_hsmi":         {},
+	"ref_src":       {},
+	"ref_url":       {},
+	"si":            {},
+	"cmpid":         {},
+	"guccounter":    {},
+	"guce_referrer": {},
+}
+
+// Deduplicator drops items that were already delivered to the same target recently, even
+// by another feed. Items are compared by their canonical URL and/or the similarity of their titles.
+type Deduplicator struct {
+	state   *StateStore
+	options DedupeOptions
+
+	// Seen reads and writes the target's history, it must not interleave.
+	mu sync.Mutex
+}
+
+type dedupeEntry struct {
+	FeedName string    `json:"feed_name"`
+	GUID     string    `json:"guid"`
+	URL      string    `json:"url,omitempty"`
+	Title    string    `json:"title,omitempty"`
+	SeenAt   time.Time `json:"seen_at"`
+}
+
+// IsEnabled returns true if items are compared in any way.
+func (o DedupeOptions) IsEnabled() bool {
+	return o.Window > 0 && (o.URL || o.TitleSimilarity > 0)
+}
+
+func NewDeduplicator(state *StateStore, options DedupeOptions) *Deduplicator {
+	return &Deduplicator{state: state, options: options}
+}
+
+// Seen reports whether a similar item was delivered to target within the window, and
+// remembers the item otherwise. target identifies the destination (e.g. the webhook URL),
+// it's hashed before being stored. Updates of the same item (same feed and GUID) are not duplicates.
+func (d *Deduplicator) Seen(target string, feedItem FeedItem, now time.Time) (bool, error) {
+	if d == nil || !d.options.IsEnabled() {
+		return false, nil
+	}
+
+	sum := sha256.Sum256([]byte(target))
+	key := hex.EncodeToString(sum[:])
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var history []dedupeEntry
+	if _, err := d.state.Get(dedupeBucket, key, &history); err != nil {
+		return false, err
+	}
+
+	current := dedupeEntry{
+		FeedName: feedItem.FeedName,
+		GUID:     feedItem.ItemGUID,
+		SeenAt:   now,
+	}
+	if d.options.URL {
+		current.URL = CanonicalURL(feedItem.ItemURL)
+	}
+	if d.options.TitleSimilarity > 0 {
+		current.Title = normalizeTitle(feedItem.ItemTitle)
+	}
+
+	recent := history[:0]
+	for _, entry := range history {
+		// Expired entries are forgotten, and so is the previous version of this item.
+		if now.Sub(entry.SeenAt) > d.options.Window || (entry.FeedName == current.FeedName && entry.GUID == current.GUID) {
+			continue
+		}
+		recent = append(recent, entry)
+	}
+
+	for _, entry := range recent {
+		if current.URL != "" && entry.URL == current.URL {
+			return true, nil
+		}
+
+		if current.Title != "" && entry.Title != "" && titleSimilarity(entry.Title, current.Title) >= d.options.TitleSimilarity {
+			return true, nil
+		}
+	}
+
+	recent = append(recent, current)
+	if err := d.state.Put(dedupeBucket, key, recent, d.options.Window); err != nil {
+		return false, fmt.Errorf("failed to remember item: %w", err)
+	}
+
+	return false, nil
+}
+
+// CanonicalURL normalizes the URL so the same article linked from different places compares
+// equal: https scheme, lowercase host without "www.", no default port, no fragment, no tracking
+// parameters, sorted query and no trailing slash. Invalid URLs are returned as they are.
+func CanonicalURL(rawURL string) string {
+	rawURL = strings.TrimSpace(rawURL)
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return rawURL
+	}
+
+	if u.Scheme == "http" {
+		u.Scheme = "https"
+	}
+
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	port := u.Port()
+	if port != "" && port != "80" && port != "443" {
+		host += ":" + port
+	}
+	u.Host = host
+	u.User = nil
+	u.Fragment = ""
+	u.RawFragment = ""
+
+	query := u.Query()
+	for name := range query {
+		lower := strings.ToLower(name)
+		if _, tracking := trackingParameters[lower]; tracking || strings.HasPrefix(lower, "utm_") {
+			query.Del(name)
+		}
+	}
+	// Encode sorts by key.
+	u.RawQuery = query.Encode()
+
+	if len(u.Path) > 1 {
+		u.Path = strings.TrimSuffix(u.Path, "/")
+		u.RawPath = ""
+	}
+	if u.Path == "/" {
+		u.Path = ""
+	}
+
+	return u.String()
+}
+
+// normalizeTitle lowercases the title and keeps only letters and digits, separated by a single space.
+func normalizeTitle(title string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(title), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}), " ")
+}
+
+// titleSimilarity is the Jaccard index of the words of both titles, 1 for the same set of words.
+func titleSimilarity(a string, b string) float64 {
+	if a == b {
+		return 1
+	}
+
+	wordsA := strings.Fields(a)
+	wordsB := strings.Fields(b)
+	if len(wordsA) == 0 || len(wordsB) == 0 {
+		return 0
+	}
+
+	set := make(map[string]int, len(wordsA)+len(wordsB))
+	for _, word := range wordsA {
+		set[word] |= 1
+	}
+	for _, word := range wordsB {
+		set[word] |= 2
+	}
+
+	shared := 0
+	for _, seen := range set {
+		if seen == 3 {
+			shared++
+		}
+	}
+
+	return float64(shared) / float64(len(set))
+}
@@ -0,0 +1,120 @@
+// Copyright 2024 Teknologi Umum <opensource@teknologiumum.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package brassite
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type amqpPublisher struct {
+	mu         sync.Mutex
+	connection *amqp.Connection
+	channel    *amqp.Channel
+}
+
+// AMQP publishers are cached per server URL. Each has a single channel in confirm mode,
+// guarded by a mutex since a channel must not be used concurrently.
+var amqpPublishers = struct {
+	sync.Mutex
+	m map[string]*amqpPublisher
+}{m: make(map[string]*amqpPublisher)}
+
+// DeliverToAMQP publishes the feed item as FeedItemMessage JSON to the exchange, with the item
+// GUID as the message ID and the feed name in the headers. The channel is in confirm mode,
+// a nack from the broker is returned as an error.
+func DeliverToAMQP(ctx context.Context, options AMQPDelivery, feedItem FeedItem) error {
+	payload, err := MarshalFeedItemMessage(feedItem)
+	if err != nil {
+		return fmt.Errorf("failed to marshal feed item: %w", err)
+	}
+
+	amqpPublishers.Lock()
+	publisher, ok := amqpPublishers.m[options.URL]
+	if !ok {
+		publisher = &amqpPublisher{}
+		amqpPublishers.m[options.URL] = publisher
+	}
+	amqpPublishers.Unlock()
+
+	publisher.mu.Lock()
+	defer publisher.mu.Unlock()
+
+	channel, err := publisher.open(options.URL)
+	if err != nil {
+		return err
+	}
+
+	confirmation, err := channel.PublishWithDeferredConfirmWithContext(ctx, options.Exchange, options.RoutingKey, false, false, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		MessageId:    feedItem.ItemGUID,
+		Timestamp:    time.Now(),
+		AppId:        "brassite",
+		Headers: amqp.Table{
+			"brassite-feed-name": feedItem.FeedName,
+			"brassite-item-guid": feedItem.ItemGUID,
+		},
+		Body: payload,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish to amqp exchange %q: %w", options.Exchange, err)
+	}
+
+	acked, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to wait for amqp confirmation: %w", err)
+	}
+	if !acked {
+		return fmt.Errorf("amqp broker did not acknowledge the message to exchange %q", options.Exchange)
+	}
+
+	return nil
+}
+
+// open returns the channel, reconnecting if the connection or channel was closed.
+func (p *amqpPublisher) open(url string) (*amqp.Channel, error) {
+	if p.connection != nil && !p.connection.IsClosed() && p.channel != nil && !p.channel.IsClosed() {
+		return p.channel, nil
+	}
+
+	if p.connection == nil || p.connection.IsClosed() {
+		connection, err := amqp.DialConfig(url, amqp.Config{
+			Properties: amqp.Table{"connection_name": "brassite"},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to amqp: %w", err)
+		}
+		p.connection = connection
+	}
+
+	channel, err := p.connection.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open amqp channel: %w", err)
+	}
+
+	err = channel.Confirm(false)
+	if err != nil {
+		_ = channel.Close()
+		return nil, fmt.Errorf("failed to put amqp channel in confirm mode: %w", err)
+	}
+
+	p.channel = channel
+	return channel, nil
+}
@@ -0,0 +1,358 @@
+// Copyright 2024 Teknologi Umum <opensource@teknologiumum.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package brassite
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	md "github.com/JohannesKaufmann/html-to-markdown"
+)
+
+// DefaultBlueskyPDSURL is the PDS used when BlueskyDelivery.PDSURL is empty.
+const DefaultBlueskyPDSURL = "https://bsky.social"
+
+// Bluesky counts the post length in graphemes, we count runes instead. There are always at
+// least as many runes as graphemes, so staying under the limit in runes is safe.
+const blueskyMaxPostLength = 300
+
+// Bluesky rejects blobs bigger than this for an external embed thumbnail.
+const blueskyMaxThumbnailSize = 1_000_000
+
+const blueskyMaxDescriptionLength = 300
+
+// Longer links are shortened in the text, like the Bluesky app does, the facet keeps the full URL.
+const blueskyMaxLinkTextLength = 100
+
+type blueskySession struct {
+	AccessJwt string `json:"accessJwt"`
+	Did       string `json:"did"`
+}
+
+type blueskyPostRecord struct {
+	Type      string         `json:"$type"`
+	Text      string         `json:"text"`
+	Facets    []blueskyFacet `json:"facets,omitempty"`
+	Embed     *blueskyEmbed  `json:"embed,omitempty"`
+	CreatedAt string         `json:"createdAt"`
+}
+
+type blueskyFacet struct {
+	Index    blueskyByteSlice      `json:"index"`
+	Features []blueskyFacetFeature `json:"features"`
+}
+
+type blueskyByteSlice struct {
+	ByteStart int `json:"byteStart"`
+	ByteEnd   int `json:"byteEnd"`
+}
+
+type blueskyFacetFeature struct {
+	Type string `json:"$type"`
+	URI  string `json:"uri"`
+}
+
+type blueskyEmbed struct {
+	Type     string               `json:"$type"`
+	External blueskyExternalEmbed `json:"external"`
+}
+
+type blueskyExternalEmbed struct {
+	URI         string          `json:"uri"`
+	Title       string          `json:"title"`
+	Description string          `json:"description"`
+	Thumb       json.RawMessage `json:"thumb,omitempty"`
+}
+
+type blueskyErrorResponse struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+// Sessions are cached per PDS and identifier, createSession is heavily rate limited
+// and we don't want to create a new session for every single item.
+var blueskySessions = struct {
+	sync.Mutex
+	m map[string]blueskySession
+}{m: make(map[string]blueskySession)}
+
+var errBlueskyExpiredToken = errors.New("bluesky session token expired")
+
+func DeliverToBluesky(ctx context.Context, options BlueskyDelivery, feedItem FeedItem) error {
+	pdsURL := strings.TrimSuffix(options.PDSURL, "/")
+	if pdsURL == "" {
+		pdsURL = DefaultBlueskyPDSURL
+	}
+
+	session, err := getBlueskySession(ctx, pdsURL, options)
+	if err != nil {
+		return err
+	}
+
+	record, err := buildBlueskyPost(ctx, pdsURL, session, feedItem)
+	if errors.Is(err, errBlueskyExpiredToken) {
+		session, err = renewBlueskySession(ctx, pdsURL, options)
+		if err != nil {
+			return err
+		}
+
+		record, err = buildBlueskyPost(ctx, pdsURL, session, feedItem)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = createBlueskyRecord(ctx, pdsURL, session, record)
+	if errors.Is(err, errBlueskyExpiredToken) {
+		session, err = renewBlueskySession(ctx, pdsURL, options)
+		if err != nil {
+			return err
+		}
+
+		err = createBlueskyRecord(ctx, pdsURL, session, record)
+	}
+
+	return err
+}
+
+func getBlueskySession(ctx context.Context, pdsURL string, options BlueskyDelivery) (blueskySession, error) {
+	blueskySessions.Lock()
+	session, ok := blueskySessions.m[pdsURL+"|"+options.Identifier]
+	blueskySessions.Unlock()
+	if ok {
+		return session, nil
+	}
+
+	return renewBlueskySession(ctx, pdsURL, options)
+}
+
+func renewBlueskySession(ctx context.Context, pdsURL string, options BlueskyDelivery) (blueskySession, error) {
+	body, err := json.Marshal(map[string]string{
+		"identifier": options.Identifier,
+		"password":   options.AppPassword,
+	})
+	if err != nil {
+		return blueskySession{}, fmt.Errorf("failed to marshal bluesky session request: %w", err)
+	}
+
+	var session blueskySession
+	err = doBlueskyRequest(ctx, pdsURL+"/xrpc/com.atproto.server.createSession", "", "application/json", bytes.NewReader(body), &session)
+	if err != nil {
+		return blueskySession{}, fmt.Errorf("failed to create bluesky session: %w", err)
+	}
+
+	blueskySessions.Lock()
+	blueskySessions.m[pdsURL+"|"+options.Identifier] = session
+	blueskySessions.Unlock()
+
+	return session, nil
+}
+
+func buildBlueskyPost(ctx context.Context, pdsURL string, session blueskySession, feedItem FeedItem) (blueskyPostRecord, error) {
+	// Reserve room for the link, the emoji and the line breaks, then give the rest to the title.
+	linkText := truncateRunes(feedItem.ItemURL, blueskyMaxLinkTextLength)
+	titleBudget := max(blueskyMaxPostLength-utf8.RuneCountInString(linkText)-4, 0)
+	title := truncateRunes(feedItem.ItemTitle, titleBudget)
+
+	text := "📰 " + title
+	var facets []blueskyFacet
+	if feedItem.ItemURL != "" {
+		text += "\n\n"
+		// Facet indexes are UTF-8 byte offsets, which is exactly what len() gives us.
+		facets = append(facets, blueskyFacet{
+			Index: blueskyByteSlice{
+				ByteStart: len(text),
+				ByteEnd:   len(text) + len(linkText),
+			},
+			Features: []blueskyFacetFeature{{Type: "app.bsky.richtext.facet#link", URI: feedItem.ItemURL}},
+		})
+		text += linkText
+	}
+
+	record := blueskyPostRecord{
+		Type:      "app.bsky.feed.post",
+		Text:      text,
+		Facets:    facets,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+
+	if feedItem.ItemURL == "" {
+		return record, nil
+	}
+
+	converter := md.NewConverter("", true, nil)
+	description, err := converter.ConvertString(feedItem.ItemDescription)
+	if err != nil {
+		return blueskyPostRecord{}, fmt.Errorf("failed to convert HTML to markdown: %w", err)
+	}
+
+	record.Embed = &blueskyEmbed{
+		Type: "app.bsky.embed.external",
+		External: blueskyExternalEmbed{
+			URI:         feedItem.ItemURL,
+			Title:       feedItem.ItemTitle,
+			Description: truncateRunes(description, blueskyMaxDescriptionLength),
+		},
+	}
+
+	if feedItem.ItemImage != "" {
+		thumb, err := uploadBlueskyThumbnail(ctx, pdsURL, session, feedItem.ItemImage)
+		if err != nil {
+			if errors.Is(err, errBlueskyExpiredToken) {
+				return blueskyPostRecord{}, err
+			}
+			// A missing thumbnail should not prevent the item from being posted,
+			// the card is still useful with only the title and description.
+		} else {
+			record.Embed.External.Thumb = thumb
+		}
+	}
+
+	return record, nil
+}
+
+func uploadBlueskyThumbnail(ctx context.Context, pdsURL string, session blueskySession, imageURL string) (json.RawMessage, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, imageURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create thumbnail request: %w", err)
+	}
+
+	request.Header.Set("User-Agent", "Brassite/1.0")
+
+	response, err := HTTPClientFromContext(ctx).Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download thumbnail: %w", err)
+	}
+	defer func() {
+		if response.Body != nil {
+			_ = response.Body.Close()
+		}
+	}()
+
+	if response.StatusCode >= 400 {
+		return nil, fmt.Errorf("thumbnail responded with %d", response.StatusCode)
+	}
+
+	image, err := io.ReadAll(io.LimitReader(response.Body, blueskyMaxThumbnailSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read thumbnail: %w", err)
+	}
+
+	if len(image) > blueskyMaxThumbnailSize {
+		return nil, fmt.Errorf("thumbnail is larger than %d bytes", blueskyMaxThumbnailSize)
+	}
+
+	contentType := response.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(image)
+	}
+
+	var uploaded struct {
+		Blob json.RawMessage `json:"blob"`
+	}
+	err = doBlueskyRequest(ctx, pdsURL+"/xrpc/com.atproto.repo.uploadBlob", session.AccessJwt, contentType, bytes.NewReader(image), &uploaded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload bluesky blob: %w", err)
+	}
+
+	return uploaded.Blob, nil
+}
+
+func createBlueskyRecord(ctx context.Context, pdsURL string, session blueskySession, record blueskyPostRecord) error {
+	body, err := json.Marshal(map[string]any{
+		"repo":       session.Did,
+		"collection": "app.bsky.feed.post",
+		"record":     record,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal bluesky post: %w", err)
+	}
+
+	err = doBlueskyRequest(ctx, pdsURL+"/xrpc/com.atproto.repo.createRecord", session.AccessJwt, "application/json", bytes.NewReader(body), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create bluesky post: %w", err)
+	}
+
+	return nil
+}
+
+func doBlueskyRequest(ctx context.Context, url string, accessJwt string, contentType string, body io.Reader, out any) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, body)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	request.Header.Set("Content-Type", contentType)
+	request.Header.Set("User-Agent", "Brassite/1.0")
+	if accessJwt != "" {
+		request.Header.Set("Authorization", "Bearer "+accessJwt)
+	}
+
+	response, err := HTTPClientFromContext(ctx).Do(request)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer func() {
+		if response.Body != nil {
+			_ = response.Body.Close()
+		}
+	}()
+
+	responseBody, err := io.ReadAll(response.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if response.StatusCode >= 400 {
+		var errorResponse blueskyErrorResponse
+		_ = json.Unmarshal(responseBody, &errorResponse)
+		if errorResponse.Error == "ExpiredToken" || errorResponse.Error == "InvalidToken" {
+			return errBlueskyExpiredToken
+		}
+
+		return fmt.Errorf("bluesky responded with %d (%s)", response.StatusCode, string(responseBody))
+	}
+
+	if out != nil {
+		err = json.Unmarshal(responseBody, out)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal response: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func truncateRunes(s string, max int) string {
+	if max <= 0 {
+		return ""
+	}
+
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+
+	runes := []rune(s)
+	return string(runes[:max-1]) + "…"
+}
@@ -17,23 +17,45 @@ package brassite
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"slices"
 	"strings"
 	"text/template"
+	"time"
 
 	md "github.com/JohannesKaufmann/html-to-markdown"
 )
 
 type discordWebhookObject struct {
-	Username  string               `json:"username"`
-	AvatarURL string               `json:"avatar_url"`
-	Content   string               `json:"content"`
-	Embeds    []discordEmbedObject `json:"embeds,omitempty"`
+	Username    string               `json:"username,omitempty"`
+	AvatarURL   string               `json:"avatar_url,omitempty"`
+	Content     string               `json:"content"`
+	Embeds      []discordEmbedObject `json:"embeds,omitempty"`
+	ThreadName  string               `json:"thread_name,omitempty"`
+	AppliedTags []string             `json:"applied_tags,omitempty"`
+	// AllowedMentions is always sent, so a stray `@everyone` in the feed content never pings anyone
+	AllowedMentions discordAllowedMentionsObject `json:"allowed_mentions"`
 }
 
+type discordAllowedMentionsObject struct {
+	Parse []string `json:"parse"`
+	Roles []string `json:"roles,omitempty"`
+	Users []string `json:"users,omitempty"`
+}
+
+// Discord limits forum post titles to 100 characters and a post to 5 tags.
+const (
+	discordMaxThreadNameLength = 100
+	discordMaxAppliedTags      = 5
+)
+
 type discordEmbedObject struct {
 	Author      discordAuthorObject  `json:"author"`
 	Title       string               `json:"title"`
@@ -69,51 +91,230 @@ type discordTemplateData struct {
 	URL     string
 }
 
-func DeliverToDiscord(ctx context.Context, webhookURL string, feedItem FeedItem, customLogo string) error {
+// Delivered messages are remembered for this long, an item updated after that is posted again.
+const discordMessageRetention = 90 * 24 * time.Hour
+
+const discordMessagesBucket = "discord_messages"
+
+type discordMessageRecord struct {
+	Message     DiscordMessage `json:"message"`
+	ContentHash string         `json:"content_hash"`
+}
+
+// DiscordRecordError is returned by DeliverToDiscordTracked when the message was posted (or
+// edited), but couldn't be recorded in the state store. The delivery itself succeeded, it must
+// not be retried. Only a later update of the item is affected: it's posted as a new message
+// instead of editing this one.
+type DiscordRecordError struct {
+	Err error
+}
+
+func (e *DiscordRecordError) Error() string {
+	return fmt.Sprintf("discord message was sent, but failed to record it: %s", e.Err.Error())
+}
+
+func (e *DiscordRecordError) Unwrap() error {
+	return e.Err
+}
+
+// DeliverToDiscordTracked delivers the feed item like DeliverToDiscord, but remembers the sent
+// message in the state store. An item that was already delivered with the same content is
+// skipped, and an item whose content changed is handled according to onUpdate. A failure to
+// remember the message is a *DiscordRecordError.
+func DeliverToDiscordTracked(ctx context.Context, state *StateStore, onUpdate UpdatePolicy, webhook DiscordWebhook, feedItem FeedItem, customLogo string, mentionRules []DiscordMentionRule) error {
+	if state == nil || feedItem.ItemGUID == "" {
+		_, err := DeliverToDiscord(ctx, webhook, feedItem, customLogo, mentionRules)
+		return err
+	}
+
+	// The webhook URL contains the webhook token, don't write it to the state file as is.
+	keyHash := sha256.Sum256([]byte(webhook.URL + "\x00" + webhook.ThreadID + "\x00" + feedItem.ItemGUID))
+	key := hex.EncodeToString(keyHash[:])
+	contentHash := discordContentHash(feedItem)
+
+	var record discordMessageRecord
+	found, err := state.Get(discordMessagesBucket, key, &record)
+	if err != nil {
+		return err
+	}
+
+	if found {
+		if record.ContentHash == contentHash {
+			return nil
+		}
+
+		switch onUpdate {
+		case UpdatePolicyIgnore:
+			return nil
+		case UpdatePolicyEdit:
+			err := EditDiscordMessage(ctx, webhook, record.Message, feedItem, customLogo, mentionRules)
+			if err == nil {
+				record.ContentHash = contentHash
+				if err := state.Put(discordMessagesBucket, key, record, discordMessageRetention); err != nil {
+					return &DiscordRecordError{Err: err}
+				}
+				return nil
+			}
+			if !errors.Is(err, errDiscordMessageNotFound) {
+				return err
+			}
+			// Someone deleted the message, post it again.
+		}
+	}
+
+	message, err := DeliverToDiscord(ctx, webhook, feedItem, customLogo, mentionRules)
+	if err != nil {
+		return err
+	}
+
+	err = state.Put(discordMessagesBucket, key, discordMessageRecord{Message: message, ContentHash: contentHash}, discordMessageRetention)
+	if err != nil {
+		return &DiscordRecordError{Err: err}
+	}
+	return nil
+}
+
+func discordContentHash(feedItem FeedItem) string {
+	hash := sha256.Sum256([]byte(feedItem.ItemTitle + "\x00" + feedItem.ItemDescription + "\x00" + feedItem.ItemURL))
+	return hex.EncodeToString(hash[:])
+}
+
+// DiscordMessage identifies a message sent through a webhook.
+type DiscordMessage struct {
+	ID string `json:"id"`
+	// ChannelID is the channel, thread, or forum post the message was sent to
+	ChannelID string `json:"channel_id"`
+}
+
+// DeliverToDiscord sends the feed item to the webhook and returns the created message.
+func DeliverToDiscord(ctx context.Context, webhook DiscordWebhook, feedItem FeedItem, customLogo string, mentionRules []DiscordMentionRule) (DiscordMessage, error) {
+	webhookObject, err := buildDiscordWebhookObject(webhook, feedItem, customLogo, mentionRules)
+	if err != nil {
+		return DiscordMessage{}, err
+	}
+
+	webhookURL, err := url.Parse(webhook.URL)
+	if err != nil {
+		return DiscordMessage{}, fmt.Errorf("failed to parse discord webhook url: %w", err)
+	}
+
+	// Without wait=true, Discord responds with 204 before the message is created,
+	// and we wouldn't know the message ID.
+	query := webhookURL.Query()
+	query.Set("wait", "true")
+	if webhook.ThreadID != "" {
+		query.Set("thread_id", webhook.ThreadID)
+	}
+	webhookURL.RawQuery = query.Encode()
+
+	return sendDiscordWebhook(ctx, http.MethodPost, webhookURL, webhookObject)
+}
+
+// EditDiscordMessage replaces the content of a message previously sent with DeliverToDiscord.
+// The username, avatar, and forum post title can't be changed by Discord's API.
+func EditDiscordMessage(ctx context.Context, webhook DiscordWebhook, message DiscordMessage, feedItem FeedItem, customLogo string, mentionRules []DiscordMentionRule) error {
+	webhookObject, err := buildDiscordWebhookObject(webhook, feedItem, customLogo, mentionRules)
+	if err != nil {
+		return err
+	}
+
+	webhookURL, err := url.Parse(webhook.URL)
+	if err != nil {
+		return fmt.Errorf("failed to parse discord webhook url: %w", err)
+	}
+
+	webhookURL = webhookURL.JoinPath("messages", message.ID)
+	// Messages inside a thread (or a forum post) can only be edited with the thread ID.
+	query := webhookURL.Query()
+	if webhook.ThreadID != "" {
+		query.Set("thread_id", webhook.ThreadID)
+	} else if webhook.ThreadName != "" && message.ChannelID != "" {
+		query.Set("thread_id", message.ChannelID)
+	}
+	webhookURL.RawQuery = query.Encode()
+
+	// Only the message content can be edited, Discord rejects the other fields.
+	_, err = sendDiscordWebhook(ctx, http.MethodPatch, webhookURL, discordWebhookObject{
+		Content:         webhookObject.Content,
+		Embeds:          webhookObject.Embeds,
+		AllowedMentions: webhookObject.AllowedMentions,
+	})
+	return err
+}
+
+func buildDiscordWebhookObject(webhook DiscordWebhook, feedItem FeedItem, customLogo string, mentionRules []DiscordMentionRule) (discordWebhookObject, error) {
 	// Prepare the webhook object
 	converter := md.NewConverter("", true, nil)
 
 	content, err := converter.ConvertString(feedItem.ItemDescription)
 	if err != nil {
-		return fmt.Errorf("failed to convert HTML to markdown: %w", err)
+		return discordWebhookObject{}, fmt.Errorf("failed to convert HTML to markdown: %w", err)
 	}
 
 	if len(content) > 0 {
 		content += "\n\n"
 	}
 
-	var sb strings.Builder
-	err = discordTemplate.Execute(&sb, discordTemplateData{
+	templateData := discordTemplateData{
 		Title:   feedItem.ItemTitle,
 		Content: content,
 		URL:     feedItem.ItemURL,
-	})
+	}
+
+	var sb strings.Builder
+	err = discordTemplate.Execute(&sb, templateData)
 	if err != nil {
-		return fmt.Errorf("failed to execute discord template: %w", err)
+		return discordWebhookObject{}, fmt.Errorf("failed to execute discord template: %w", err)
+	}
+
+	roles, users := discordMentions(mentionRules, feedItem)
+	message := sb.String()
+	if mention := formatDiscordMentions(roles, users); mention != "" {
+		message = mention + "\n" + message
 	}
 
 	webhookObject := discordWebhookObject{
 		Username:  feedItem.ChannelTitle,
 		AvatarURL: customLogo,
-		Content:   sb.String(),
+		Content:   message,
+		AllowedMentions: discordAllowedMentionsObject{
+			Parse: []string{},
+			Roles: roles,
+			Users: users,
+		},
 	}
 
+	if webhook.ThreadName != "" {
+		webhookObject.ThreadName, err = discordThreadName(webhook.ThreadName, templateData)
+		if err != nil {
+			return discordWebhookObject{}, err
+		}
+		webhookObject.AppliedTags = discordAppliedTags(webhook.ForumTags, feedItem.ItemCategories)
+	}
+
+	return webhookObject, nil
+}
+
+// errDiscordMessageNotFound is returned when the message we want to edit was deleted.
+var errDiscordMessageNotFound = errors.New("discord message not found")
+
+func sendDiscordWebhook(ctx context.Context, method string, webhookURL *url.URL, webhookObject discordWebhookObject) (DiscordMessage, error) {
 	body, err := json.Marshal(webhookObject)
 	if err != nil {
-		return fmt.Errorf("failed to marshal discord webhook object: %w", err)
+		return DiscordMessage{}, fmt.Errorf("failed to marshal discord webhook object: %w", err)
 	}
 
-	request, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(body))
+	request, err := http.NewRequestWithContext(ctx, method, webhookURL.String(), bytes.NewReader(body))
 	if err != nil {
-		return fmt.Errorf("failed to create discord webhook request: %w", err)
+		return DiscordMessage{}, fmt.Errorf("failed to create discord webhook request: %w", err)
 	}
 
 	request.Header.Set("Content-Type", "application/json")
 	request.Header.Set("User-Agent", "Brassite/1.0")
 
-	response, err := http.DefaultClient.Do(request)
+	response, err := HTTPClientFromContext(ctx).Do(request)
 	if err != nil {
-		return fmt.Errorf("failed to send discord webhook: %w", err)
+		return DiscordMessage{}, fmt.Errorf("failed to send discord webhook: %w", err)
 	}
 	defer func() {
 		if response.Body != nil {
@@ -121,11 +322,102 @@ func DeliverToDiscord(ctx context.Context, webhookURL string, feedItem FeedItem,
 		}
 	}()
 
+	responseBody, _ := io.ReadAll(response.Body)
+
+	if response.StatusCode == http.StatusNotFound && method == http.MethodPatch {
+		return DiscordMessage{}, errDiscordMessageNotFound
+	}
+
 	if response.StatusCode >= 400 {
-		responseBody, _ := io.ReadAll(response.Body)
+		return DiscordMessage{}, fmt.Errorf("discord webhook responded with %d (%s)", response.StatusCode, string(responseBody))
+	}
 
-		return fmt.Errorf("discord webhook responded with %d (%s)", response.StatusCode, string(responseBody))
+	var message DiscordMessage
+	if len(responseBody) > 0 {
+		_ = json.Unmarshal(responseBody, &message)
 	}
 
-	return nil
+	return message, nil
+}
+
+func discordThreadName(nameTemplate string, data discordTemplateData) (string, error) {
+	tmpl, err := template.New("thread_name").Parse(nameTemplate)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse discord thread name template: %w", err)
+	}
+
+	var sb strings.Builder
+	err = tmpl.Execute(&sb, data)
+	if err != nil {
+		return "", fmt.Errorf("failed to execute discord thread name template: %w", err)
+	}
+
+	name := strings.Join(strings.Fields(sb.String()), " ")
+	if name == "" {
+		// Discord refuses to create a forum post without a title.
+		name = "Untitled"
+	}
+
+	return truncateRunes(name, discordMaxThreadNameLength), nil
+}
+
+// discordAppliedTags maps the item categories to forum tag IDs, without duplicates.
+func discordAppliedTags(forumTags map[string]string, categories []string) []string {
+	if len(forumTags) == 0 {
+		return nil
+	}
+
+	lowercaseTags := make(map[string]string, len(forumTags))
+	for category, tag := range forumTags {
+		lowercaseTags[strings.ToLower(category)] = tag
+	}
+
+	var tags []string
+	for _, category := range categories {
+		tag, ok := lowercaseTags[strings.ToLower(strings.TrimSpace(category))]
+		if !ok || slices.Contains(tags, tag) {
+			continue
+		}
+
+		tags = append(tags, tag)
+		if len(tags) == discordMaxAppliedTags {
+			break
+		}
+	}
+
+	return tags
+}
+
+// discordMentions collects the role and user IDs of every rule matching the item, without duplicates.
+func discordMentions(rules []DiscordMentionRule, feedItem FeedItem) (roles []string, users []string) {
+	for _, rule := range rules {
+		if !rule.Match.Match(feedItem) {
+			continue
+		}
+
+		for _, role := range rule.Roles {
+			if !slices.Contains(roles, role) {
+				roles = append(roles, role)
+			}
+		}
+		for _, user := range rule.Users {
+			if !slices.Contains(users, user) {
+				users = append(users, user)
+			}
+		}
+	}
+
+	return roles, users
+}
+
+func formatDiscordMentions(roles []string, users []string) string {
+	mentions := make([]string, 0, len(roles)+len(users))
+	for _, role := range roles {
+		mentions = append(mentions, "<@&"+role+">")
+	}
+	for _, user := range users {
+		mentions = append(mentions, "<@"+user+">")
+	}
+
+	return strings.Join(mentions, " ")
 }
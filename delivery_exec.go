@@ -0,0 +1,131 @@
+// Copyright 2024 Teknologi Umum <opensource@teknologiumum.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package brassite
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// DefaultExecTimeout is used when ExecDelivery.Timeout is not set.
+const DefaultExecTimeout = 30 * time.Second
+
+// We don't want a chatty script to fill the memory or the Sentry event.
+const execMaxStderrSize = 4096
+
+// Environment variables are limited in size (128 KiB each on Linux), long texts are truncated.
+const execMaxEnvironmentValue = 4096
+
+// DeliverToExec runs the command once for the feed item. The item is written to stdin as
+// FeedItemMessage JSON, and its fields are exposed as `BRASSITE_*` environment variables.
+// A non-zero exit code or exceeding the timeout is a failed delivery, the captured stderr
+// is included in the returned error.
+func DeliverToExec(ctx context.Context, options ExecDelivery, feedItem FeedItem) error {
+	if len(options.Command) == 0 {
+		return errors.New("exec command is empty")
+	}
+
+	payload, err := MarshalFeedItemMessage(feedItem)
+	if err != nil {
+		return fmt.Errorf("failed to marshal feed item: %w", err)
+	}
+
+	timeout := options.Timeout
+	if timeout <= 0 {
+		timeout = DefaultExecTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var stderr limitedBuffer
+	stderr.limit = execMaxStderrSize
+
+	command := exec.CommandContext(ctx, options.Command[0], options.Command[1:]...)
+	command.Stdin = bytes.NewReader(payload)
+	command.Stderr = &stderr
+	command.Env = append(os.Environ(), execEnvironment(feedItem)...)
+	// Don't wait forever for grandchildren that are still holding stderr after the kill.
+	command.WaitDelay = time.Second
+
+	err = command.Run()
+	if err != nil {
+		if ctx.Err() != nil {
+			err = fmt.Errorf("timed out after %s: %w", timeout, ctx.Err())
+		}
+
+		if output := strings.TrimSpace(stderr.String()); output != "" {
+			return fmt.Errorf("exec %s failed: %w (stderr: %s)", options.Command[0], err, output)
+		}
+
+		return fmt.Errorf("exec %s failed: %w", options.Command[0], err)
+	}
+
+	return nil
+}
+
+// execEnvironment truncates the long texts, the item description can be big enough to exceed
+// the limits on the environment size. The full text is on stdin.
+func execEnvironment(feedItem FeedItem) []string {
+	environment := []string{
+		"BRASSITE_FEED_NAME=" + stripNUL(feedItem.FeedName),
+		"BRASSITE_CHANNEL_TITLE=" + stripNUL(feedItem.ChannelTitle),
+		"BRASSITE_CHANNEL_DESCRIPTION=" + stripNUL(truncateRunes(feedItem.ChannelDescription, execMaxEnvironmentValue)),
+		"BRASSITE_CHANNEL_URL=" + stripNUL(feedItem.ChannelURL),
+		"BRASSITE_ITEM_GUID=" + stripNUL(feedItem.ItemGUID),
+		"BRASSITE_ITEM_TITLE=" + stripNUL(truncateRunes(feedItem.ItemTitle, execMaxEnvironmentValue)),
+		"BRASSITE_ITEM_DESCRIPTION=" + stripNUL(truncateRunes(feedItem.ItemDescription, execMaxEnvironmentValue)),
+		"BRASSITE_ITEM_DATE=" + stripNUL(feedItem.ItemDate),
+		"BRASSITE_ITEM_URL=" + stripNUL(feedItem.ItemURL),
+		"BRASSITE_ITEM_IMAGE=" + stripNUL(feedItem.ItemImage),
+	}
+
+	if !feedItem.ItemPublished.IsZero() {
+		environment = append(environment, "BRASSITE_ITEM_PUBLISHED="+feedItem.ItemPublished.UTC().Format(time.RFC3339))
+	}
+	if !feedItem.FetchedAt.IsZero() {
+		environment = append(environment, "BRASSITE_FETCHED_AT="+feedItem.FetchedAt.UTC().Format(time.RFC3339))
+	}
+
+	return environment
+}
+
+// stripNUL removes the NUL bytes, the command fails to start with one in its environment.
+func stripNUL(s string) string {
+	return strings.ReplaceAll(s, "\x00", "")
+}
+
+// limitedBuffer keeps the first limit bytes written to it and silently drops the rest.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if remaining := b.limit - b.Len(); remaining > 0 {
+		if len(p) > remaining {
+			b.Buffer.Write(p[:remaining])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
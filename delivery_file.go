@@ -0,0 +1,257 @@
+// Copyright 2024 Teknologi Umum <opensource@teknologiumum.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package brassite
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// File writes are serialized per path pattern, multiple feeds may share the same archive.
+var fileLocks = struct {
+	sync.Mutex
+	m map[string]*sync.Mutex
+}{m: make(map[string]*sync.Mutex)}
+
+// fileRotationDirectives maps the strftime-like directives supported in FileDelivery.Path
+// to their Go time layout.
+var fileRotationDirectives = map[byte]string{
+	'Y': "2006",
+	'm': "01",
+	'd': "02",
+	'H': "15",
+}
+
+// FileCompressionError is returned by DeliverToFile when the item was archived, but the rotated
+// files couldn't be compressed. The delivery itself succeeded, it must not be retried.
+type FileCompressionError struct {
+	Err error
+}
+
+func (e *FileCompressionError) Error() string {
+	return fmt.Sprintf("item was archived, but failed to compress rotated files: %s", e.Err.Error())
+}
+
+func (e *FileCompressionError) Unwrap() error {
+	return e.Err
+}
+
+// DeliverToFile appends the feed item as a FeedItemMessage JSON line to the file. The path may
+// contain time directives (`%Y`, `%m`, `%d`, `%H`) which are expanded using the current
+// UTC time, so `items-%Y-%m.jsonl` rotates monthly. When GzipRotated is set, every file
+// matching the pattern other than the current one is compressed on rotation, a failure to do
+// so is a *FileCompressionError.
+func DeliverToFile(ctx context.Context, options FileDelivery, feedItem FeedItem) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	payload, err := MarshalFeedItemMessage(feedItem)
+	if err != nil {
+		return fmt.Errorf("failed to marshal feed item: %w", err)
+	}
+
+	lock := fileLock(options.Path)
+	lock.Lock()
+	defer lock.Unlock()
+
+	path := ExpandFilePath(options.Path, time.Now().UTC())
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("failed to create directory %s: %w", dir, err)
+		}
+	}
+
+	_, statErr := os.Stat(path)
+	rotated := os.IsNotExist(statErr)
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+
+	// A single write call per line, so a crash never leaves half a record in the middle of the file.
+	_, err = file.Write(append(payload, '\n'))
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to write to %s: %w", path, err)
+	}
+
+	err = file.Sync()
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to sync %s: %w", path, err)
+	}
+
+	err = file.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close %s: %w", path, err)
+	}
+
+	if rotated && options.GzipRotated && path != options.Path {
+		err = gzipRotatedFiles(options.Path, path)
+		if err != nil {
+			return &FileCompressionError{Err: err}
+		}
+	}
+
+	return nil
+}
+
+// ExpandFilePath replaces the time directives in the path pattern, `%%` is a literal `%`.
+func ExpandFilePath(pattern string, now time.Time) string {
+	var sb strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] == '%' && i+1 < len(pattern) {
+			if layout, ok := fileRotationDirectives[pattern[i+1]]; ok {
+				sb.WriteString(now.Format(layout))
+				i++
+				continue
+			}
+			if pattern[i+1] == '%' {
+				sb.WriteByte('%')
+				i++
+				continue
+			}
+		}
+		sb.WriteByte(pattern[i])
+	}
+	return sb.String()
+}
+
+func fileLock(pattern string) *sync.Mutex {
+	fileLocks.Lock()
+	defer fileLocks.Unlock()
+
+	lock, ok := fileLocks.m[pattern]
+	if !ok {
+		lock = &sync.Mutex{}
+		fileLocks.m[pattern] = lock
+	}
+	return lock
+}
+
+// gzipRotatedFiles compresses every file matching the pattern, except the current one.
+// We glob for them instead of remembering the previous path, so files that were rotated
+// while brassite was not running are compressed as well.
+func gzipRotatedFiles(pattern string, current string) error {
+	// Glob metacharacters in the path are literal, a character class works on every platform
+	// (backslashes are separators on Windows, not escapes).
+	glob := strings.NewReplacer("[", "[[]", "*", "[*]", "?", "[?]").Replace(pattern)
+	for directive := range fileRotationDirectives {
+		glob = strings.ReplaceAll(glob, "%"+string(directive), "*")
+	}
+	matches, err := filepath.Glob(glob)
+	if err != nil {
+		return err
+	}
+
+	// One file failing doesn't keep the others from being compressed.
+	var errs []error
+	for _, match := range matches {
+		if match == current || strings.HasSuffix(match, ".gz") || strings.HasSuffix(match, ".gz.tmp") {
+			continue
+		}
+
+		if err := gzipFile(match); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// gzipFile compresses the file to <path>.gz and removes it. The archive is written to a
+// temporary file first, so an existing <path>.gz was left behind by a crash before the file
+// was removed, which is all that's left to do. It's checked anyway, just in case.
+func gzipFile(path string) error {
+	if _, err := os.Stat(path + ".gz"); err == nil {
+		if validGzipFile(path + ".gz") {
+			return os.Remove(path)
+		}
+	}
+
+	source, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = source.Close()
+	}()
+
+	temporary := path + ".gz.tmp"
+	target, err := os.OpenFile(temporary, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+
+	writer := gzip.NewWriter(target)
+	if _, err := io.Copy(writer, source); err != nil {
+		_ = target.Close()
+		_ = os.Remove(temporary)
+		return err
+	}
+
+	if err := writer.Close(); err != nil {
+		_ = target.Close()
+		_ = os.Remove(temporary)
+		return err
+	}
+
+	if err := target.Sync(); err != nil {
+		_ = target.Close()
+		_ = os.Remove(temporary)
+		return err
+	}
+
+	if err := target.Close(); err != nil {
+		_ = os.Remove(temporary)
+		return err
+	}
+
+	if err := os.Rename(temporary, path+".gz"); err != nil {
+		_ = os.Remove(temporary)
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// validGzipFile returns true if the whole file decompresses without error.
+func validGzipFile(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		return false
+	}
+
+	_, err = io.Copy(io.Discard, reader)
+	return err == nil
+}
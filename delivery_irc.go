@@ -0,0 +1,440 @@
+// Copyright 2024 Teknologi Umum <opensource@teknologiumum.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package brassite
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IRC lines are limited to 512 bytes including the prefix the server prepends when relaying
+// our message, keep the text well below that so it doesn't get truncated.
+const ircMaxMessageLength = 400
+
+// Flood control: allow a small burst, then one line every ircFloodInterval.
+// Libera and most other networks will kick clients that go faster than this.
+const (
+	ircFloodBurst    = 4
+	ircFloodInterval = 2 * time.Second
+)
+
+const (
+	ircDialTimeout    = 30 * time.Second
+	ircReadTimeout    = 10 * time.Minute
+	ircMaxBackoff     = 5 * time.Minute
+	ircQueueSize      = 256
+	ircDefaultTLSPort = "6697"
+	ircDefaultPort    = "6667"
+)
+
+// IRCClient is a persistent connection to an IRC network. A single client is meant to be
+// shared by every feed that delivers to the same network.
+type IRCClient struct {
+	network IRCNetwork
+	queue   chan ircMessage
+
+	mu      sync.Mutex
+	conn    net.Conn
+	writeMu sync.Mutex
+}
+
+type ircMessage struct {
+	// ctx is the sender's, a message whose sender gave up is not sent anymore
+	ctx     context.Context
+	channel string
+	text    string
+	// done receives the result of the write, it's buffered so the writer never blocks
+	done chan error
+}
+
+// NewIRCClient creates a new IRC client for the network. Call Run to actually connect.
+func NewIRCClient(network IRCNetwork) *IRCClient {
+	return &IRCClient{
+		network: network,
+		queue:   make(chan ircMessage, ircQueueSize),
+	}
+}
+
+// Network returns the network the client connects to.
+func (c *IRCClient) Network() IRCNetwork {
+	return c.network
+}
+
+// Run keeps the connection alive until ctx is cancelled, reconnecting with an exponential
+// backoff whenever the connection drops. onError is called for every connection failure.
+func (c *IRCClient) Run(ctx context.Context, onError func(error)) {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := c.session(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil && onError != nil {
+			onError(fmt.Errorf("irc connection to %s: %w", c.network.Server, err))
+		}
+
+		// A connection that stayed up for a while resets the backoff.
+		if time.Since(start) > ircMaxBackoff {
+			backoff = time.Second
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > ircMaxBackoff {
+			backoff = ircMaxBackoff
+		}
+	}
+}
+
+// Send sends a PRIVMSG to channel and waits until it's written to the connection, so the
+// outbox only considers it delivered once it actually left. Messages are kept in the queue
+// while the client is reconnecting and sent once the channels are joined again, unless ctx
+// is done by then.
+func (c *IRCClient) Send(ctx context.Context, channel string, text string) error {
+	// Callers are expected to clean their text already, but a line break slipping through
+	// would let the rest of the text run as IRC commands on our connection.
+	message := ircMessage{
+		ctx:     ctx,
+		channel: stripIRCControl(channel),
+		text:    stripIRCControl(text),
+		done:    make(chan error, 1),
+	}
+
+	select {
+	case c.queue <- message:
+	case <-ctx.Done():
+		return fmt.Errorf("irc queue for %s is full: %w", c.network.Name, ctx.Err())
+	}
+
+	select {
+	case err := <-message.done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("irc message to %s was not sent in time: %w", c.network.Name, ctx.Err())
+	}
+}
+
+func (c *IRCClient) session(ctx context.Context) error {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+
+	c.mu.Lock()
+	c.conn = conn
+	c.mu.Unlock()
+
+	sessionCtx, cancel := context.WithCancel(ctx)
+	defer func() {
+		cancel()
+		_ = conn.Close()
+		c.mu.Lock()
+		c.conn = nil
+		c.mu.Unlock()
+	}()
+
+	go func() {
+		<-sessionCtx.Done()
+		_ = conn.Close()
+	}()
+
+	nick := c.network.Nick
+	if c.network.SASLUsername != "" {
+		if err := c.writeLine("CAP REQ :sasl"); err != nil {
+			return err
+		}
+	}
+	if err := c.writeLine("NICK " + nick); err != nil {
+		return err
+	}
+	if err := c.writeLine(fmt.Sprintf("USER %s 0 * :%s", c.username(), c.realname())); err != nil {
+		return err
+	}
+
+	ready := make(chan struct{})
+	readyOnce := sync.Once{}
+	go c.sendQueued(sessionCtx, ready)
+
+	reader := bufio.NewReader(conn)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(ircReadTimeout))
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("failed to read: %w", err)
+		}
+
+		command, params := parseIRCLine(line)
+		switch command {
+		case "PING":
+			err = c.writeLine("PONG :" + lastParam(params))
+		case "CAP":
+			if len(params) >= 2 && params[1] == "ACK" {
+				err = c.writeLine("AUTHENTICATE PLAIN")
+			} else if len(params) >= 2 && params[1] == "NAK" {
+				return errors.New("server does not support SASL")
+			}
+		case "AUTHENTICATE":
+			if lastParam(params) == "+" {
+				payload := c.network.SASLUsername + "\x00" + c.network.SASLUsername + "\x00" + c.network.SASLPassword
+				err = c.writeLine("AUTHENTICATE " + base64.StdEncoding.EncodeToString([]byte(payload)))
+			}
+		case "903": // RPL_SASLSUCCESS
+			err = c.writeLine("CAP END")
+		case "902", "904", "905", "906": // SASL failures
+			return fmt.Errorf("SASL authentication failed: %s", lastParam(params))
+		case "433": // ERR_NICKNAMEINUSE
+			nick += "_"
+			err = c.writeLine("NICK " + nick)
+		case "001": // RPL_WELCOME
+			if c.network.NickServPassword != "" {
+				err = c.writeLine("PRIVMSG NickServ :IDENTIFY " + c.network.NickServPassword)
+				if err != nil {
+					return err
+				}
+			}
+			for _, channel := range c.network.Channels {
+				if err = c.writeLine("JOIN " + channel); err != nil {
+					return err
+				}
+			}
+			readyOnce.Do(func() { close(ready) })
+		case "ERROR":
+			return fmt.Errorf("server closed the connection: %s", lastParam(params))
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (c *IRCClient) dial(ctx context.Context) (net.Conn, error) {
+	address := c.network.Server
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		if c.network.TLS {
+			address = net.JoinHostPort(address, ircDefaultTLSPort)
+		} else {
+			address = net.JoinHostPort(address, ircDefaultPort)
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: ircDialTimeout, KeepAlive: time.Minute}
+	if !c.network.TLS {
+		return dialer.DialContext(ctx, "tcp", address)
+	}
+
+	host, _, _ := net.SplitHostPort(address)
+	tlsDialer := &tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: host}}
+	return tlsDialer.DialContext(ctx, "tcp", address)
+}
+
+// sendQueued drains the message queue once the client has joined the channels,
+// throttled with a simple token bucket to stay below the network's flood limit.
+func (c *IRCClient) sendQueued(ctx context.Context, ready <-chan struct{}) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-ready:
+	}
+
+	tokens := ircFloodBurst
+	ticker := time.NewTicker(ircFloodInterval)
+	defer ticker.Stop()
+
+	for {
+		if tokens == 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				tokens++
+			}
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if tokens < ircFloodBurst {
+				tokens++
+			}
+		case message := <-c.queue:
+			if message.ctx.Err() != nil {
+				// The sender gave up, it will be retried from the outbox.
+				message.done <- message.ctx.Err()
+				continue
+			}
+
+			if err := c.writeLine("PRIVMSG " + message.channel + " :" + message.text); err != nil {
+				// Put it back so it's sent after we reconnect. If the queue is full, the
+				// sender is told it failed and retries later.
+				select {
+				case c.queue <- message:
+				default:
+					message.done <- err
+				}
+				return
+			}
+			message.done <- nil
+			tokens--
+		}
+	}
+}
+
+func (c *IRCClient) writeLine(line string) error {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn == nil {
+		return errors.New("not connected")
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	_ = conn.SetWriteDeadline(time.Now().Add(ircDialTimeout))
+	_, err := conn.Write([]byte(line + "\r\n"))
+	if err != nil {
+		return fmt.Errorf("failed to write: %w", err)
+	}
+
+	return nil
+}
+
+func (c *IRCClient) username() string {
+	if c.network.Username != "" {
+		return c.network.Username
+	}
+	return c.network.Nick
+}
+
+func (c *IRCClient) realname() string {
+	if c.network.Realname != "" {
+		return c.network.Realname
+	}
+	return "Brassite"
+}
+
+// DeliverToIRC sends a one-line summary of the feed item to each channel.
+func DeliverToIRC(ctx context.Context, client *IRCClient, channels []string, feedItem FeedItem) error {
+	if client == nil {
+		return errors.New("irc client is not configured")
+	}
+
+	if len(channels) == 0 {
+		channels = client.network.Channels
+	}
+
+	text := formatIRCMessage(feedItem)
+	for _, channel := range channels {
+		if err := client.Send(ctx, channel, text); err != nil {
+			return fmt.Errorf("failed to send irc message to %s: %w", channel, err)
+		}
+	}
+
+	return nil
+}
+
+func formatIRCMessage(feedItem FeedItem) string {
+	// Every field comes from the feed, CR and LF would end our PRIVMSG and start a new command.
+	title := ircText(feedItem.ItemTitle)
+	if channelTitle := ircText(feedItem.ChannelTitle); channelTitle != "" {
+		title = "[" + channelTitle + "] " + title
+	}
+
+	suffix := ""
+	if itemURL := stripIRCControl(feedItem.ItemURL); itemURL != "" {
+		suffix = " — " + itemURL
+	}
+
+	budget := ircMaxMessageLength - len(suffix)
+	if len(title) > budget {
+		// Cut on a rune boundary, IRC servers don't like broken UTF-8.
+		cut := 0
+		for i := range title {
+			if i > budget-len("…") {
+				break
+			}
+			cut = i
+		}
+		title = title[:cut] + "…"
+	}
+
+	return title + suffix
+}
+
+// ircText collapses the whitespace (line breaks included) of s and drops the characters IRC can't carry.
+func ircText(s string) string {
+	return stripIRCControl(strings.Join(strings.Fields(s), " "))
+}
+
+// stripIRCControl removes CR, LF, and NUL, which can't appear in the middle of an IRC line.
+func stripIRCControl(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' || r == 0 {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// parseIRCLine returns the command and parameters of a raw IRC line, dropping the
+// message tags and the prefix since we don't care who sent it.
+func parseIRCLine(line string) (command string, params []string) {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, "@") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+	if strings.HasPrefix(line, ":") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+
+	line, trailing, hasTrailing := strings.Cut(line, " :")
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", nil
+	}
+
+	command = strings.ToUpper(fields[0])
+	params = fields[1:]
+	if hasTrailing {
+		params = append(params, trailing)
+	}
+
+	return command, params
+}
+
+func lastParam(params []string) string {
+	if len(params) == 0 {
+		return ""
+	}
+	return params[len(params)-1]
+}
@@ -0,0 +1,113 @@
+// Copyright 2024 Teknologi Umum <opensource@teknologiumum.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package brassite
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+// Kafka writers are cached per brokers, topic, and credentials, they hold their own connection pool.
+var kafkaWriters = struct {
+	sync.Mutex
+	m map[string]*kafka.Writer
+}{m: make(map[string]*kafka.Writer)}
+
+// DeliverToKafka produces the feed item as FeedItemMessage JSON to the topic, keyed by the
+// item GUID so every version of the same item lands on the same partition. The write waits
+// for every in-sync replica to acknowledge it.
+func DeliverToKafka(ctx context.Context, options KafkaDelivery, feedItem FeedItem) error {
+	writer, err := getKafkaWriter(options)
+	if err != nil {
+		return err
+	}
+
+	payload, err := MarshalFeedItemMessage(feedItem)
+	if err != nil {
+		return fmt.Errorf("failed to marshal feed item: %w", err)
+	}
+
+	err = writer.WriteMessages(ctx, kafka.Message{
+		Key:   []byte(feedItem.ItemGUID),
+		Value: payload,
+		Headers: []kafka.Header{
+			{Key: "content-type", Value: []byte("application/json")},
+			{Key: "brassite-feed-name", Value: []byte(feedItem.FeedName)},
+			{Key: "brassite-item-guid", Value: []byte(feedItem.ItemGUID)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to produce to kafka topic %s: %w", options.Topic, err)
+	}
+
+	return nil
+}
+
+func getKafkaWriter(options KafkaDelivery) (*kafka.Writer, error) {
+	key := connectionKey(strings.Join(options.Brokers, ","), options.Topic, strconv.FormatBool(options.TLS), options.Username, options.Password, strings.ToLower(options.SASLMechanism))
+
+	kafkaWriters.Lock()
+	defer kafkaWriters.Unlock()
+
+	if writer, ok := kafkaWriters.m[key]; ok {
+		return writer, nil
+	}
+
+	transport := &kafka.Transport{ClientID: "brassite"}
+	if options.TLS {
+		transport.TLS = &tls.Config{}
+	}
+
+	if options.Username != "" {
+		mechanism, err := kafkaSASLMechanism(options)
+		if err != nil {
+			return nil, err
+		}
+		transport.SASL = mechanism
+	}
+
+	writer := &kafka.Writer{
+		Addr:         kafka.TCP(options.Brokers...),
+		Topic:        options.Topic,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+		Transport:    transport,
+	}
+
+	kafkaWriters.m[key] = writer
+	return writer, nil
+}
+
+func kafkaSASLMechanism(options KafkaDelivery) (sasl.Mechanism, error) {
+	switch strings.ToLower(options.SASLMechanism) {
+	case "", "plain":
+		return plain.Mechanism{Username: options.Username, Password: options.Password}, nil
+	case "scram-sha-256":
+		return scram.Mechanism(scram.SHA256, options.Username, options.Password)
+	case "scram-sha-512":
+		return scram.Mechanism(scram.SHA512, options.Username, options.Password)
+	default:
+		return nil, fmt.Errorf("unsupported kafka sasl mechanism %q", options.SASLMechanism)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2024 Teknologi Umum <opensource@teknologiumum.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package brassite
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const mqttConnectTimeout = 30 * time.Second
+
+// MQTT clients are cached per broker, client ID, and credentials, brokers kick the older connection
+// when a second one connects with the same client ID.
+var mqttClients = struct {
+	sync.Mutex
+	m map[string]mqtt.Client
+}{m: make(map[string]mqtt.Client)}
+
+// DeliverToMQTT publishes the feed item as FeedItemMessage JSON to the topic. MQTT 3.1.1 has no
+// message headers, consumers should read the feed name and GUID from the payload. With QoS 1
+// or 2 we wait for the broker's acknowledgement, with QoS 0 we only know it was written.
+func DeliverToMQTT(ctx context.Context, options MQTTDelivery, feedItem FeedItem) error {
+	client, err := getMQTTClient(options)
+	if err != nil {
+		return err
+	}
+
+	payload, err := MarshalFeedItemMessage(feedItem)
+	if err != nil {
+		return fmt.Errorf("failed to marshal feed item: %w", err)
+	}
+
+	token := client.Publish(options.Topic, options.QoS, options.Retain, payload)
+	select {
+	case <-token.Done():
+	case <-ctx.Done():
+		return fmt.Errorf("failed to publish to mqtt topic %s: %w", options.Topic, ctx.Err())
+	}
+
+	if err := token.Error(); err != nil {
+		return fmt.Errorf("failed to publish to mqtt topic %s: %w", options.Topic, err)
+	}
+
+	return nil
+}
+
+func getMQTTClient(options MQTTDelivery) (mqtt.Client, error) {
+	clientID := options.ClientID
+	if clientID == "" {
+		clientID = "brassite"
+	}
+	key := connectionKey(options.Broker, clientID, options.Username, options.Password)
+
+	mqttClients.Lock()
+	defer mqttClients.Unlock()
+
+	if client, ok := mqttClients.m[key]; ok {
+		return client, nil
+	}
+
+	clientOptions := mqtt.NewClientOptions().
+		AddBroker(options.Broker).
+		SetClientID(clientID).
+		SetUsername(options.Username).
+		SetPassword(options.Password).
+		SetAutoReconnect(true).
+		SetConnectTimeout(mqttConnectTimeout)
+
+	client := mqtt.NewClient(clientOptions)
+	token := client.Connect()
+	if !token.WaitTimeout(mqttConnectTimeout) {
+		return nil, fmt.Errorf("timed out connecting to mqtt broker %s", options.Broker)
+	}
+	if err := token.Error(); err != nil {
+		return nil, fmt.Errorf("failed to connect to mqtt broker %s: %w", options.Broker, err)
+	}
+
+	mqttClients.m[key] = client
+	return client, nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2024 Teknologi Umum <opensource@teknologiumum.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package brassite
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+)
+
+// NATS connections are cached per server URL and credentials, the client reconnects by itself.
+var natsConnections = struct {
+	sync.Mutex
+	m map[string]*nats.Conn
+}{m: make(map[string]*nats.Conn)}
+
+// DeliverToNATS publishes the feed item as FeedItemMessage JSON to the subject. The feed name
+// and GUID are sent as headers, the GUID doubles as `Nats-Msg-Id` so JetStream can deduplicate.
+//
+// Core NATS has no acknowledgement, so we flush the connection to make sure the server got the
+// message. With JetStream enabled we wait for the stream's publish acknowledgement instead.
+func DeliverToNATS(ctx context.Context, options NATSDelivery, feedItem FeedItem) error {
+	conn, err := getNATSConnection(options)
+	if err != nil {
+		return err
+	}
+
+	payload, err := MarshalFeedItemMessage(feedItem)
+	if err != nil {
+		return fmt.Errorf("failed to marshal feed item: %w", err)
+	}
+
+	message := nats.NewMsg(options.Subject)
+	message.Data = payload
+	message.Header.Set("Content-Type", "application/json")
+	message.Header.Set("Brassite-Feed-Name", feedItem.FeedName)
+	message.Header.Set("Brassite-Item-Guid", feedItem.ItemGUID)
+	if feedItem.ItemGUID != "" {
+		message.Header.Set(nats.MsgIdHdr, feedItem.ItemGUID)
+	}
+
+	if options.JetStream {
+		jetStream, err := conn.JetStream()
+		if err != nil {
+			return fmt.Errorf("failed to create jetstream context: %w", err)
+		}
+
+		_, err = jetStream.PublishMsg(message, nats.Context(ctx))
+		if err != nil {
+			return fmt.Errorf("failed to publish to jetstream subject %s: %w", options.Subject, err)
+		}
+
+		return nil
+	}
+
+	err = conn.PublishMsg(message)
+	if err != nil {
+		return fmt.Errorf("failed to publish to nats subject %s: %w", options.Subject, err)
+	}
+
+	err = conn.FlushWithContext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to flush nats connection: %w", err)
+	}
+
+	return nil
+}
+
+func getNATSConnection(options NATSDelivery) (*nats.Conn, error) {
+	key := connectionKey(options.URL, options.Username, options.Password, options.Token, options.CredentialsFile)
+
+	natsConnections.Lock()
+	defer natsConnections.Unlock()
+
+	if conn, ok := natsConnections.m[key]; ok && !conn.IsClosed() {
+		return conn, nil
+	}
+
+	natsOptions := []nats.Option{nats.Name("Brassite"), nats.MaxReconnects(-1)}
+	if options.Username != "" {
+		natsOptions = append(natsOptions, nats.UserInfo(options.Username, options.Password))
+	}
+	if options.Token != "" {
+		natsOptions = append(natsOptions, nats.Token(options.Token))
+	}
+	if options.CredentialsFile != "" {
+		natsOptions = append(natsOptions, nats.UserCredentials(options.CredentialsFile))
+	}
+
+	conn, err := nats.Connect(options.URL, natsOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to nats: %w", err)
+	}
+
+	natsConnections.m[key] = conn
+	return conn, nil
+}
+
+// connectionKey identifies a cached connection of the message queue deliveries. Every field
+// that changes the connection (credentials included) must be part of it, otherwise targets on
+// the same broker would publish under the identity of whichever connected first. It's hashed
+// so the credentials don't linger in memory as map keys.
+func connectionKey(fields ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(fields, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,174 @@
+// Copyright 2024 Teknologi Umum <opensource@teknologiumum.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package brassite
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const heldItemsBucket = "held_items"
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "sunday": time.Sunday,
+	"mon": time.Monday, "monday": time.Monday,
+	"tue": time.Tuesday, "tuesday": time.Tuesday,
+	"wed": time.Wednesday, "wednesday": time.Wednesday,
+	"thu": time.Thursday, "thursday": time.Thursday,
+	"fri": time.Friday, "friday": time.Friday,
+	"sat": time.Saturday, "saturday": time.Saturday,
+}
+
+// IsEnabled returns true if the window restricts anything.
+func (w DeliveryWindow) IsEnabled() bool {
+	return len(w.Days) > 0 || len(w.Hours) > 0
+}
+
+// Validate checks the time zone, days, and hour ranges of the window.
+func (w DeliveryWindow) Validate() error {
+	if _, err := w.location(); err != nil {
+		return err
+	}
+
+	for _, day := range w.Days {
+		if _, ok := weekdays[strings.ToLower(strings.TrimSpace(day))]; !ok {
+			return fmt.Errorf("unknown day %q, use mon, tue, wed, thu, fri, sat, or sun", day)
+		}
+	}
+
+	for _, hours := range w.Hours {
+		if _, _, err := parseHourRange(hours); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// IsOpen returns true if items may be delivered at t. An invalid window is always open,
+// we'd rather deliver at 3 AM than lose items.
+func (w DeliveryWindow) IsOpen(t time.Time) bool {
+	if !w.IsEnabled() {
+		return true
+	}
+
+	location, err := w.location()
+	if err != nil {
+		return true
+	}
+	t = t.In(location)
+
+	if len(w.Days) > 0 {
+		found := false
+		for _, day := range w.Days {
+			if weekdays[strings.ToLower(strings.TrimSpace(day))] == t.Weekday() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(w.Hours) == 0 {
+		return true
+	}
+
+	minute := t.Hour()*60 + t.Minute()
+	for _, hours := range w.Hours {
+		start, end, err := parseHourRange(hours)
+		if err != nil {
+			return true
+		}
+
+		if start <= end {
+			if minute >= start && minute < end {
+				return true
+			}
+		} else if minute >= start || minute < end {
+			// The range wraps around midnight, e.g. 22:00-06:00
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsUrgent returns true if the item should skip the window.
+func (w DeliveryWindow) IsUrgent(feedItem FeedItem) bool {
+	return w.Urgent.Match(feedItem)
+}
+
+func (w DeliveryWindow) location() (*time.Location, error) {
+	if w.TimeZone == "" {
+		return time.Local, nil
+	}
+
+	location, err := time.LoadLocation(w.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone %q: %w", w.TimeZone, err)
+	}
+	return location, nil
+}
+
+// parseHourRange parses "HH:MM-HH:MM" into minutes since midnight.
+func parseHourRange(hours string) (start int, end int, err error) {
+	from, to, found := strings.Cut(strings.TrimSpace(hours), "-")
+	if !found {
+		return 0, 0, fmt.Errorf("invalid hour range %q, expected HH:MM-HH:MM", hours)
+	}
+
+	start, err = parseClock(from)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid hour range %q: %w", hours, err)
+	}
+
+	end, err = parseClock(to)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid hour range %q: %w", hours, err)
+	}
+
+	if start == end {
+		return 0, 0, fmt.Errorf("invalid hour range %q, start and end are the same", hours)
+	}
+
+	return start, end, nil
+}
+
+func parseClock(clock string) (int, error) {
+	clock = strings.TrimSpace(clock)
+	// 24:00 is a valid end of the day.
+	if clock == "24:00" {
+		return 24 * 60, nil
+	}
+
+	parsed, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a HH:MM time", clock)
+	}
+	return parsed.Hour()*60 + parsed.Minute(), nil
+}
+
+// HoldItem keeps the feed item in the state until the delivery window opens again.
+func HoldItem(state *StateStore, feedName string, feedItem FeedItem) error {
+	return enqueueItem(state, heldItemsBucket, feedName, feedItem)
+}
+
+// TakeHeldItems returns the items held for the feed and clears them.
+func TakeHeldItems(state *StateStore, feedName string) ([]FeedItem, error) {
+	return takeQueuedItems(state, heldItemsBucket, feedName)
+}
@@ -0,0 +1,168 @@
+// Copyright 2024 Teknologi Umum <opensource@teknologiumum.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package brassite
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/robfig/cron/v3"
+)
+
+const (
+	digestItemsBucket  = "digest_items"
+	digestSentAtBucket = "digest_sent_at"
+)
+
+// Digest items are told apart from regular ones by the prefix of their GUID.
+const digestGUIDPrefix = "digest:"
+
+// DefaultDigestMaxItems is used when DigestOptions.MaxItems is not set.
+const DefaultDigestMaxItems = 10
+
+// The list stops once the titles and links add up to this many characters, whatever MaxItems
+// is. Discord rejects messages over 2000 characters, this leaves room for the title and the link.
+const digestMaxListLength = 1400
+
+// IsEnabled returns true if the feed should be delivered as a digest.
+func (d DigestOptions) IsEnabled() bool {
+	return d.Schedule != "" || d.Interval > 0
+}
+
+// Next returns when the next digest should be sent, lastSent is zero if it was never sent.
+func (d DigestOptions) Next(now time.Time, lastSent time.Time) (time.Time, error) {
+	if d.Schedule != "" {
+		schedule, err := cron.ParseStandard(d.Schedule)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid digest schedule: %w", err)
+		}
+		return schedule.Next(now), nil
+	}
+
+	if lastSent.IsZero() {
+		return now.Add(d.Interval), nil
+	}
+
+	next := lastSent.Add(d.Interval)
+	if next.Before(now) {
+		// We were down when the digest was due, send it right away.
+		return now, nil
+	}
+	return next, nil
+}
+
+// AddToDigest queues the feed item for the next digest of the feed. An item that is already
+// queued (same GUID) is replaced with the newer version.
+func AddToDigest(state *StateStore, feedName string, feedItem FeedItem) error {
+	return enqueueItem(state, digestItemsBucket, feedName, feedItem)
+}
+
+// TakeDigest returns the queued items of the feed and clears the queue.
+func TakeDigest(state *StateStore, feedName string, sentAt time.Time) ([]FeedItem, error) {
+	items, err := takeQueuedItems(state, digestItemsBucket, feedName)
+	if err != nil {
+		return nil, err
+	}
+
+	err = state.Put(digestSentAtBucket, feedName, sentAt.UTC(), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+// DigestLastSent returns when the last digest of the feed was sent, zero if never.
+func DigestLastSent(state *StateStore, feedName string) time.Time {
+	var sentAt time.Time
+	_, _ = state.Get(digestSentAtBucket, feedName, &sentAt)
+	return sentAt
+}
+
+// IsDigestItem returns true if the feed item was built by BuildDigestItem.
+func IsDigestItem(feedItem FeedItem) bool {
+	return strings.HasPrefix(feedItem.ItemGUID, digestGUIDPrefix)
+}
+
+// BuildDigestItem summarizes the items into a single feed item, so it can be sent through
+// every deliverer unchanged. The content is an HTML list of links, only the first maxItems
+// items are listed, and fewer if their titles and links are too long for a Discord message.
+func BuildDigestItem(feedName string, items []FeedItem, maxItems int, now time.Time) FeedItem {
+	if maxItems <= 0 {
+		maxItems = DefaultDigestMaxItems
+	}
+
+	var sb strings.Builder
+	sb.WriteString("<ul>")
+	listed := 0
+	listLength := 0
+	for _, item := range items {
+		if listed == maxItems {
+			break
+		}
+
+		// Roughly the length of the Markdown `- [title](url)` line it turns into.
+		length := utf8.RuneCountInString(item.ItemTitle) + utf8.RuneCountInString(item.ItemURL) + 8
+		if listed > 0 && listLength+length > digestMaxListLength {
+			break
+		}
+		listLength += length
+		listed++
+
+		sb.WriteString("<li>")
+		if item.ItemURL != "" {
+			sb.WriteString(`<a href="` + html.EscapeString(item.ItemURL) + `">` + html.EscapeString(item.ItemTitle) + "</a>")
+		} else {
+			sb.WriteString(html.EscapeString(item.ItemTitle))
+		}
+		sb.WriteString("</li>")
+	}
+	sb.WriteString("</ul>")
+
+	if len(items) > listed {
+		sb.WriteString(fmt.Sprintf("<p>…and %d more.</p>", len(items)-listed))
+	}
+
+	digest := FeedItem{
+		FeedName:        feedName,
+		ItemGUID:        fmt.Sprintf(digestGUIDPrefix+"%s:%d", feedName, now.Unix()),
+		ItemDescription: sb.String(),
+		ItemDate:        now.Format(time.Stamp),
+		ItemPublished:   now,
+		FetchedAt:       now,
+	}
+
+	if len(items) > 0 {
+		digest.ChannelTitle = items[0].ChannelTitle
+		digest.ChannelDescription = items[0].ChannelDescription
+		digest.ChannelURL = items[0].ChannelURL
+		digest.ItemURL = items[0].ChannelURL
+	}
+
+	title := feedName
+	if digest.ChannelTitle != "" {
+		title = digest.ChannelTitle
+	}
+	if len(items) == 1 {
+		digest.ItemTitle = fmt.Sprintf("%s: 1 new item", title)
+	} else {
+		digest.ItemTitle = fmt.Sprintf("%s: %d new items", title, len(items))
+	}
+
+	return digest
+}
@@ -0,0 +1,179 @@
+// Copyright 2024 Teknologi Umum <opensource@teknologiumum.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package brassite
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+const discoveredFeedsBucket = "discovered_feeds"
+
+// Discovered feed URLs are looked up again once in a while, in case the site moves its feed.
+const discoveredFeedTTL = 7 * 24 * time.Hour
+
+// Feed types advertised with <link rel="alternate" type="...">, by MIME type.
+var feedLinkTypes = map[string]string{
+	"application/rss+xml":   "rss",
+	"application/atom+xml":  "atom",
+	"application/feed+json": "json",
+}
+
+// FeedCandidate is a feed advertised by an HTML page.
+type FeedCandidate struct {
+	URL string
+	// Type is one of rss, atom, or json
+	Type  string
+	Title string
+}
+
+type discoveredFeed struct {
+	PageURL string `json:"page_url"`
+	FeedURL string `json:"feed_url"`
+}
+
+// IsHTMLResponse returns true if the response is a web page rather than a feed.
+func IsHTMLResponse(contentType string, body []byte) bool {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		switch mediaType {
+		case "text/html", "application/xhtml+xml":
+			return true
+		case "text/plain", "application/octet-stream":
+			// Servers that don't know better, sniff the body instead.
+		default:
+			return false
+		}
+	}
+
+	return strings.HasPrefix(http.DetectContentType(body), "text/html")
+}
+
+// DiscoverFeeds lists the feeds advertised by the HTML page, in the order they appear.
+// Relative links are resolved against pageURL (or the page's <base>).
+func DiscoverFeeds(pageURL string, body []byte) ([]FeedCandidate, error) {
+	base, err := url.Parse(pageURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid page url: %w", err)
+	}
+
+	document, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse HTML: %w", err)
+	}
+
+	if href, ok := document.Find("base[href]").First().Attr("href"); ok {
+		if baseHref, err := base.Parse(strings.TrimSpace(href)); err == nil {
+			base = baseHref
+		}
+	}
+
+	var candidates []FeedCandidate
+	seen := make(map[string]struct{})
+	document.Find("link[rel][href]").Each(func(_ int, link *goquery.Selection) {
+		rel, _ := link.Attr("rel")
+		if !containsFold(strings.Fields(rel), "alternate") {
+			return
+		}
+
+		linkType, _ := link.Attr("type")
+		mediaType, _, _ := mime.ParseMediaType(linkType)
+		feedType, ok := feedLinkTypes[mediaType]
+		if !ok {
+			return
+		}
+
+		href, _ := link.Attr("href")
+		resolved, err := base.Parse(strings.TrimSpace(href))
+		if err != nil {
+			return
+		}
+
+		if _, duplicate := seen[resolved.String()]; duplicate {
+			return
+		}
+		seen[resolved.String()] = struct{}{}
+
+		title, _ := link.Attr("title")
+		candidates = append(candidates, FeedCandidate{URL: resolved.String(), Type: feedType, Title: strings.TrimSpace(title)})
+	})
+
+	return candidates, nil
+}
+
+// PickFeedCandidate picks the feed to follow: the first one of the preferred type (rss, atom,
+// or json) if set, otherwise the first one that's not a comments feed.
+func PickFeedCandidate(candidates []FeedCandidate, prefer string) (FeedCandidate, bool) {
+	if len(candidates) == 0 {
+		return FeedCandidate{}, false
+	}
+
+	if prefer != "" {
+		for _, candidate := range candidates {
+			if strings.EqualFold(candidate.Type, prefer) {
+				return candidate, true
+			}
+		}
+	}
+
+	for _, candidate := range candidates {
+		if !isCommentsFeed(candidate) {
+			return candidate, true
+		}
+	}
+
+	return candidates[0], true
+}
+
+func isCommentsFeed(candidate FeedCandidate) bool {
+	return strings.Contains(strings.ToLower(candidate.Title), "comment") ||
+		strings.Contains(strings.ToLower(candidate.URL), "comment")
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// DiscoveredFeedURL returns the feed URL discovered earlier on the feed's page, if it's still
+// the page in the configuration.
+func DiscoveredFeedURL(state *StateStore, feedName string, pageURL string) (string, bool) {
+	var discovered discoveredFeed
+	found, err := state.Get(discoveredFeedsBucket, feedName, &discovered)
+	if err != nil || !found || discovered.PageURL != pageURL {
+		return "", false
+	}
+	return discovered.FeedURL, true
+}
+
+// RememberDiscoveredFeed caches the feed URL discovered on the page, so the page isn't fetched on every poll.
+func RememberDiscoveredFeed(state *StateStore, feedName string, pageURL string, feedURL string) error {
+	return state.Put(discoveredFeedsBucket, feedName, discoveredFeed{PageURL: pageURL, FeedURL: feedURL}, discoveredFeedTTL)
+}
+
+// ForgetDiscoveredFeed drops the cached feed URL, the page is looked up again on the next poll.
+func ForgetDiscoveredFeed(state *StateStore, feedName string) error {
+	return state.Delete(discoveredFeedsBucket, feedName)
+}
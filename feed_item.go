@@ -14,13 +14,94 @@
 
 package brassite
 
+import (
+	"encoding/json"
+	"time"
+)
+
 type FeedItem struct {
+	// FeedName is the name of the feed as written in the configuration file
+	FeedName string
+
 	ChannelTitle       string
 	ChannelDescription string
 	ChannelURL         string
 
+	// ItemGUID is the raw GUID (or Atom ID) of the item, falls back to the item URL
+	ItemGUID        string
 	ItemTitle       string
 	ItemDescription string
 	ItemDate        string
 	ItemURL         string
+	// ItemPublished is the parsed publish date, zero if the feed doesn't provide one
+	ItemPublished time.Time
+	// ItemImage is the URL of the item's image or thumbnail, if the feed provides one
+	ItemImage string
+	// ItemCategories are the categories (or tags) of the item
+	ItemCategories []string
+	// ItemAuthors are the names of the item authors
+	ItemAuthors []string
+
+	// FetchedAt is when brassite fetched the feed containing this item
+	FetchedAt time.Time
+}
+
+// FeedItemMessageSchemaVersion is bumped whenever FeedItemMessage changes in a
+// backward incompatible way.
+const FeedItemMessageSchemaVersion = 1
+
+// FeedItemMessage is the stable JSON representation of a FeedItem, used by every
+// deliverer that hands the item over to another program (message queues, files, etc.).
+// Don't rename or remove fields here, consumers depend on them.
+type FeedItemMessage struct {
+	SchemaVersion      int        `json:"schema_version"`
+	FeedName           string     `json:"feed_name"`
+	GUID               string     `json:"guid"`
+	ChannelTitle       string     `json:"channel_title"`
+	ChannelDescription string     `json:"channel_description"`
+	ChannelURL         string     `json:"channel_url"`
+	Title              string     `json:"title"`
+	Description        string     `json:"description"`
+	Date               string     `json:"date"`
+	PublishedAt        *time.Time `json:"published_at,omitempty"`
+	URL                string     `json:"url"`
+	Image              string     `json:"image,omitempty"`
+	Categories         []string   `json:"categories,omitempty"`
+	FetchedAt          *time.Time `json:"fetched_at,omitempty"`
+}
+
+func NewFeedItemMessage(feedItem FeedItem) FeedItemMessage {
+	var publishedAt *time.Time
+	if !feedItem.ItemPublished.IsZero() {
+		published := feedItem.ItemPublished.UTC()
+		publishedAt = &published
+	}
+
+	var fetchedAt *time.Time
+	if !feedItem.FetchedAt.IsZero() {
+		fetched := feedItem.FetchedAt.UTC()
+		fetchedAt = &fetched
+	}
+
+	return FeedItemMessage{
+		SchemaVersion:      FeedItemMessageSchemaVersion,
+		FeedName:           feedItem.FeedName,
+		GUID:               feedItem.ItemGUID,
+		ChannelTitle:       feedItem.ChannelTitle,
+		ChannelDescription: feedItem.ChannelDescription,
+		ChannelURL:         feedItem.ChannelURL,
+		Title:              feedItem.ItemTitle,
+		Description:        feedItem.ItemDescription,
+		Date:               feedItem.ItemDate,
+		PublishedAt:        publishedAt,
+		URL:                feedItem.ItemURL,
+		Image:              feedItem.ItemImage,
+		Categories:         feedItem.ItemCategories,
+		FetchedAt:          fetchedAt,
+	}
+}
+
+// MarshalFeedItemMessage encodes the feed item as FeedItemMessage JSON.
+func MarshalFeedItemMessage(feedItem FeedItem) ([]byte, error) {
+	return json.Marshal(NewFeedItemMessage(feedItem))
 }
@@ -0,0 +1,148 @@
+// Copyright 2024 Teknologi Umum <opensource@teknologiumum.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package brassite
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// FetchLimiter caps how many feeds are fetched at the same time, in total and per host, and
+// spaces out the requests to the same host. A nil FetchLimiter doesn't limit anything.
+type FetchLimiter struct {
+	global    chan struct{}
+	perHost   int
+	hostDelay time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*hostLimiter
+}
+
+type hostLimiter struct {
+	slots chan struct{}
+
+	mu sync.Mutex
+	// next is the earliest time the next request to the host may start
+	next time.Time
+}
+
+// StartupDelay is a random delay before the first poll of a feed, so they don't all start at once.
+func (o PollingOptions) StartupDelay() time.Duration {
+	return randomDuration(o.StartupJitter)
+}
+
+// PollJitter is a random delay added to every interval, so feeds with the same interval drift apart.
+func (o PollingOptions) PollJitter() time.Duration {
+	return randomDuration(o.Jitter)
+}
+
+func randomDuration(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return rand.N(max)
+}
+
+func NewFetchLimiter(options PollingOptions) *FetchLimiter {
+	limiter := &FetchLimiter{
+		perHost:   options.MaxConcurrentFetchesPerHost,
+		hostDelay: options.HostDelay,
+		hosts:     make(map[string]*hostLimiter),
+	}
+	if options.MaxConcurrentFetches > 0 {
+		limiter.global = make(chan struct{}, options.MaxConcurrentFetches)
+	}
+	return limiter
+}
+
+// Acquire waits for a free slot to fetch from host, release must be called once the response
+// is read. It returns ctx's error if ctx is done before a slot is free.
+func (l *FetchLimiter) Acquire(ctx context.Context, host string) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	h := l.host(host)
+
+	// Wait for our turn on the host first, so we don't sit on a global slot while being polite.
+	if l.hostDelay > 0 {
+		h.mu.Lock()
+		now := time.Now()
+		start := h.next
+		if start.Before(now) {
+			start = now
+		}
+		h.next = start.Add(l.hostDelay)
+		h.mu.Unlock()
+
+		if wait := time.Until(start); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, ctx.Err()
+			case <-timer.C:
+			}
+		}
+	}
+
+	if h.slots != nil {
+		select {
+		case h.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	if l.global != nil {
+		select {
+		case l.global <- struct{}{}:
+		case <-ctx.Done():
+			if h.slots != nil {
+				<-h.slots
+			}
+			return nil, ctx.Err()
+		}
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if l.global != nil {
+				<-l.global
+			}
+			if h.slots != nil {
+				<-h.slots
+			}
+		})
+	}, nil
+}
+
+func (l *FetchLimiter) host(name string) *hostLimiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	h, ok := l.hosts[name]
+	if !ok {
+		h = &hostLimiter{}
+		if l.perHost > 0 {
+			h.slots = make(chan struct{}, l.perHost)
+		}
+		l.hosts[name] = h
+	}
+	return h
+}
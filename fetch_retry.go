@@ -0,0 +1,171 @@
+// Copyright 2024 Teknologi Umum <opensource@teknologiumum.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package brassite
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Defaults used when RetryOptions fields are not set.
+const (
+	DefaultFetchRetryAttempts   = 3
+	DefaultFetchRetryBackoff    = 10 * time.Second
+	DefaultFetchRetryMaxBackoff = time.Minute
+)
+
+// FetchError is returned when the feed responds with an error status code.
+type FetchError struct {
+	StatusCode int
+	// RetryAfter is the delay asked by the server on 429 and 503, zero if none
+	RetryAfter time.Duration
+}
+
+func (e *FetchError) Error() string {
+	return fmt.Sprintf("feed responded with %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// NewFetchError creates a FetchError from the response, reading its Retry-After header.
+func NewFetchError(response *http.Response, now time.Time) *FetchError {
+	fetchErr := &FetchError{StatusCode: response.StatusCode}
+	if response.StatusCode == http.StatusTooManyRequests || response.StatusCode == http.StatusServiceUnavailable {
+		fetchErr.RetryAfter = ParseRetryAfter(response.Header.Get("Retry-After"), now)
+	}
+	return fetchErr
+}
+
+// IsRetryableFetchError returns true for errors that may go away on their own: timeouts,
+// refused, reset, or closed connections, temporary DNS failures, 5xx, and 429. Anything else
+// (404, an unknown host, a bad certificate, a broken feed, etc.) will fail again.
+func IsRetryableFetchError(err error) bool {
+	var fetchErr *FetchError
+	if errors.As(err, &fetchErr) {
+		return fetchErr.StatusCode == http.StatusTooManyRequests || fetchErr.StatusCode >= 500
+	}
+
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+
+	// The server closed a keep-alive connection, or cut the response short.
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsTemporary {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// ParseRetryAfter reads a Retry-After header, given either in seconds or as an HTTP date.
+// It returns zero when the header is missing or invalid.
+func ParseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+
+	return 0
+}
+
+// MaxAttempts is the number of retries after the first attempt, 0 if retries are disabled.
+func (o RetryOptions) MaxAttempts() int {
+	switch {
+	case o.Attempts < 0:
+		return 0
+	case o.Attempts == 0:
+		return DefaultFetchRetryAttempts
+	default:
+		return o.Attempts
+	}
+}
+
+// Backoff is the delay before the given retry (starting at 1), doubled on every retry.
+func (o RetryOptions) Backoff(retry int) time.Duration {
+	backoff := o.InitialBackoff
+	if backoff <= 0 {
+		backoff = DefaultFetchRetryBackoff
+	}
+
+	maxBackoff := o.BackoffLimit()
+	for i := 1; i < retry && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	return backoff
+}
+
+// BackoffLimit is the longest we wait between two attempts, a longer Retry-After skips the retries.
+func (o RetryOptions) BackoffLimit() time.Duration {
+	if o.MaxBackoff <= 0 {
+		return DefaultFetchRetryMaxBackoff
+	}
+	return o.MaxBackoff
+}
+
+// IsEnabled returns true if failing feeds are escalated.
+func (o EscalationOptions) IsEnabled() bool {
+	return o.After > 0
+}
+
+// Merge returns the options with the ones set in override taking precedence. Used to apply
+// the feed's escalation options on top of the global ones.
+func (o EscalationOptions) Merge(override EscalationOptions) EscalationOptions {
+	if override.After != 0 {
+		o.After = override.After
+	}
+	if !override.Delivery.IsEmpty() {
+		o.Delivery = override.Delivery
+	}
+	return o
+}
+
+// NewFeedFailureAlert creates the item sent to the escalation delivery when a feed keeps failing.
+func NewFeedFailureAlert(feed Feed, failures int, err error, now time.Time) FeedItem {
+	return FeedItem{
+		FeedName:        feed.Name,
+		ChannelTitle:    "Brassite",
+		ItemGUID:        fmt.Sprintf("brassite-alert-%s-%d", feed.Name, now.Unix()),
+		ItemTitle:       fmt.Sprintf("Feed %s failed %d times in a row", feed.Name, failures),
+		ItemDescription: fmt.Sprintf("Fetching %s failed: %s", feed.URL, err.Error()),
+		ItemDate:        now.Format(time.Stamp),
+		ItemURL:         feed.URL,
+		ItemPublished:   now,
+		FetchedAt:       now,
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2024 Teknologi Umum <opensource@teknologiumum.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package brassite
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+)
+
+const firstSeenBucket = "first_seen"
+
+// Items that left the page are forgotten after a while, so the list doesn't grow forever.
+// An item coming back after that is new again.
+const firstSeenRetention = 30 * 24 * time.Hour
+
+// StampFirstSeen remembers when each item of a source without reliable dates (like a scraped
+// page, where dates often lack the time of day) was first seen. Items that weren't there on the
+// previous poll get their UpdatedParsed set to now, and PublishedParsed if they had no date, so
+// they're picked up as new exactly once. The items seen before get both dates set to when they
+// were first seen, a date in the future (or moving around) doesn't make them new again. Nothing
+// is stamped on the very first poll of the feed, otherwise the whole page would be delivered.
+func StampFirstSeen(state *StateStore, feedName string, items []*gofeed.Item, now time.Time) error {
+	seen := make(map[string]time.Time)
+	found, err := state.Get(firstSeenBucket, feedName, &seen)
+	if err != nil {
+		return err
+	}
+
+	onPage := make(map[string]struct{}, len(items))
+	for _, item := range items {
+		key := firstSeenKey(item)
+		onPage[key] = struct{}{}
+
+		if firstSeen, ok := seen[key]; ok {
+			item.PublishedParsed = &firstSeen
+			item.UpdatedParsed = &firstSeen
+			continue
+		}
+
+		seen[key] = now.UTC()
+		if !found {
+			continue
+		}
+
+		stamp := now
+		item.UpdatedParsed = &stamp
+		if item.PublishedParsed == nil {
+			item.PublishedParsed = &stamp
+		}
+	}
+
+	for key, firstSeen := range seen {
+		if _, ok := onPage[key]; !ok && now.Sub(firstSeen) > firstSeenRetention {
+			delete(seen, key)
+		}
+	}
+
+	return state.Put(firstSeenBucket, feedName, seen, 0)
+}
+
+const seenItemsBucket = "seen_items"
+
+// Polls and WebSub notifications of the same feed filter their items concurrently, the whole
+// read-modify-write on the state must not interleave or an item could be delivered twice.
+var seenItemsMu sync.Mutex
+
+type seenItem struct {
+	SeenAt time.Time `json:"seen_at"`
+	// UpdatedAt is the item's own updated (or published) date when it was last seen
+	UpdatedAt time.Time `json:"updated_at,omitempty"`
+}
+
+// FilterUnseenItems returns the items that weren't seen before, or that were updated since,
+// and records them all as seen. It's for sources that can't be filtered by date, like the
+// content pushed by a WebSub hub, which is often the whole feed. Nothing is returned until
+// the feed has been seen once, otherwise the whole feed would be delivered.
+func FilterUnseenItems(state *StateStore, feedName string, items []*gofeed.Item, now time.Time) ([]*gofeed.Item, error) {
+	return filterUnseenItems(state, feedName, items, nil, false, now)
+}
+
+// FilterUnseenPolledItems is FilterUnseenItems for the new items of a poll, shared with the
+// WebSub notifications of the feed. The older items of the poll are recorded as seen without
+// being returned, and the new items go through on the very first poll as well.
+func FilterUnseenPolledItems(state *StateStore, feedName string, newItems []*gofeed.Item, oldItems []*gofeed.Item, now time.Time) ([]*gofeed.Item, error) {
+	return filterUnseenItems(state, feedName, newItems, oldItems, true, now)
+}
+
+func filterUnseenItems(state *StateStore, feedName string, items []*gofeed.Item, known []*gofeed.Item, polled bool, now time.Time) ([]*gofeed.Item, error) {
+	seenItemsMu.Lock()
+	defer seenItemsMu.Unlock()
+
+	seen := make(map[string]seenItem)
+	found, err := state.Get(seenItemsBucket, feedName, &seen)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, item := range known {
+		seen[firstSeenKey(item)] = seenItem{SeenAt: now.UTC(), UpdatedAt: itemUpdatedAt(item)}
+	}
+	found = found || polled
+
+	var unseen []*gofeed.Item
+	for _, item := range items {
+		key := firstSeenKey(item)
+		updatedAt := itemUpdatedAt(item)
+
+		previous, ok := seen[key]
+		if found && (!ok || updatedAt.After(previous.UpdatedAt)) {
+			unseen = append(unseen, item)
+		}
+
+		seen[key] = seenItem{SeenAt: now.UTC(), UpdatedAt: updatedAt}
+	}
+
+	for key, item := range seen {
+		if now.Sub(item.SeenAt) > firstSeenRetention {
+			delete(seen, key)
+		}
+	}
+
+	return unseen, state.Put(seenItemsBucket, feedName, seen, 0)
+}
+
+// itemUpdatedAt returns the updated date of the item, or its published date.
+func itemUpdatedAt(item *gofeed.Item) time.Time {
+	if item.UpdatedParsed != nil {
+		return item.UpdatedParsed.UTC()
+	}
+	if item.PublishedParsed != nil {
+		return item.PublishedParsed.UTC()
+	}
+	return time.Time{}
+}
+
+func firstSeenKey(item *gofeed.Item) string {
+	if item.GUID != "" {
+		return item.GUID
+	}
+	return item.Link
+}
@@ -0,0 +1,289 @@
+// Copyright 2024 Teknologi Umum <opensource@teknologiumum.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package brassite
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+// DefaultGitHubBaseURL is the REST API used when GitHubSourceOptions.BaseURL is empty.
+const DefaultGitHubBaseURL = "https://api.github.com"
+
+// Same as the API's default page size, plenty for anything polled more than once a week.
+const githubPerPage = 30
+
+var githubRepositoryPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+/[A-Za-z0-9_.-]+$`)
+
+var githubMarkdown = goldmark.New(goldmark.WithExtensions(extension.GFM))
+
+type githubUser struct {
+	Login string `json:"login"`
+}
+
+type githubRelease struct {
+	ID          int64      `json:"id"`
+	HTMLURL     string     `json:"html_url"`
+	TagName     string     `json:"tag_name"`
+	Name        string     `json:"name"`
+	Body        string     `json:"body"`
+	Draft       bool       `json:"draft"`
+	Prerelease  bool       `json:"prerelease"`
+	PublishedAt *time.Time `json:"published_at"`
+	Author      githubUser `json:"author"`
+}
+
+type githubTag struct {
+	Name   string `json:"name"`
+	Commit struct {
+		SHA string `json:"sha"`
+	} `json:"commit"`
+}
+
+type githubCommit struct {
+	SHA     string `json:"sha"`
+	HTMLURL string `json:"html_url"`
+	Commit  struct {
+		Message string `json:"message"`
+		Author  struct {
+			Name string `json:"name"`
+		} `json:"author"`
+		Committer struct {
+			Date time.Time `json:"date"`
+		} `json:"committer"`
+	} `json:"commit"`
+}
+
+// APIURL is the REST API endpoint listing the items of the repository.
+func (o GitHubSourceOptions) APIURL() string {
+	apiURL := fmt.Sprintf("%s/repos/%s/%s?per_page=%d", o.baseURL(), o.Repository, o.kind(), githubPerPage)
+	if o.kind() == GitHubCommits && o.Branch != "" {
+		apiURL += "&sha=" + url.QueryEscape(o.Branch)
+	}
+	return apiURL
+}
+
+// APIHeaders returns the headers of the API request, on top of the feed's own headers.
+func (o GitHubSourceOptions) APIHeaders(headers map[string]string) map[string]string {
+	merged := map[string]string{
+		"Accept":               "application/vnd.github+json",
+		"X-GitHub-Api-Version": "2022-11-28",
+	}
+	if o.Token != "" {
+		merged["Authorization"] = "Bearer " + o.Token
+	}
+
+	for key, value := range headers {
+		merged[key] = value
+	}
+
+	return merged
+}
+
+// RepositoryURL is the web page of the repository.
+func (o GitHubSourceOptions) RepositoryURL() string {
+	base := o.baseURL()
+	switch {
+	case base == DefaultGitHubBaseURL:
+		base = "https://github.com"
+	case strings.HasSuffix(base, "/api/v3"):
+		// GitHub Enterprise Server
+		base = strings.TrimSuffix(base, "/api/v3")
+	}
+
+	return base + "/" + o.Repository
+}
+
+func (o GitHubSourceOptions) baseURL() string {
+	if o.BaseURL == "" {
+		return DefaultGitHubBaseURL
+	}
+	return strings.TrimSuffix(o.BaseURL, "/")
+}
+
+func (o GitHubSourceOptions) kind() GitHubSourceKind {
+	if o.Kind == "" {
+		return GitHubReleases
+	}
+	return o.Kind
+}
+
+// ParseGitHubResponse turns the API response for APIURL into feed items. Releases carry their
+// notes as content and a `release` or `prerelease` category, drafts are always left out.
+func ParseGitHubResponse(options GitHubSourceOptions, body []byte) (*gofeed.Feed, error) {
+	repositoryURL := options.RepositoryURL()
+	feed := &gofeed.Feed{
+		Title:    fmt.Sprintf("%s %s", options.Repository, options.kind()),
+		Link:     repositoryURL,
+		FeedLink: options.APIURL(),
+		FeedType: "github",
+	}
+
+	switch options.kind() {
+	case GitHubReleases:
+		var releases []githubRelease
+		if err := json.Unmarshal(body, &releases); err != nil {
+			return nil, fmt.Errorf("failed to parse releases: %w", err)
+		}
+
+		for _, release := range releases {
+			if release.Draft || (release.Prerelease && !options.IncludePrereleases) {
+				continue
+			}
+
+			title := release.Name
+			if strings.TrimSpace(title) == "" {
+				title = release.TagName
+			}
+
+			category := "release"
+			if release.Prerelease {
+				category = "prerelease"
+			}
+
+			content := renderGitHubMarkdown(release.Body)
+			item := &gofeed.Item{
+				Title:           title,
+				Link:            release.HTMLURL,
+				GUID:            release.HTMLURL,
+				Content:         content,
+				Description:     content,
+				PublishedParsed: release.PublishedAt,
+				Categories:      []string{category},
+			}
+			if release.PublishedAt != nil {
+				item.Published = release.PublishedAt.Format(time.RFC3339)
+			}
+			if release.Author.Login != "" {
+				item.Authors = []*gofeed.Person{{Name: release.Author.Login}}
+			}
+
+			feed.Items = append(feed.Items, item)
+		}
+
+	case GitHubTags:
+		var tags []githubTag
+		if err := json.Unmarshal(body, &tags); err != nil {
+			return nil, fmt.Errorf("failed to parse tags: %w", err)
+		}
+
+		// Tags have no date in the API, they're picked up when they first appear.
+		for _, tag := range tags {
+			link := repositoryURL + "/releases/tag/" + url.PathEscape(tag.Name)
+			feed.Items = append(feed.Items, &gofeed.Item{
+				Title:      tag.Name,
+				Link:       link,
+				GUID:       link,
+				Categories: []string{"tag"},
+			})
+		}
+
+	case GitHubCommits:
+		var commits []githubCommit
+		if err := json.Unmarshal(body, &commits); err != nil {
+			return nil, fmt.Errorf("failed to parse commits: %w", err)
+		}
+
+		for _, commit := range commits {
+			title, message, _ := strings.Cut(strings.TrimSpace(commit.Commit.Message), "\n")
+			content := renderGitHubMarkdown(strings.TrimSpace(message))
+
+			published := commit.Commit.Committer.Date
+			item := &gofeed.Item{
+				Title:           title,
+				Link:            commit.HTMLURL,
+				GUID:            commit.SHA,
+				Content:         content,
+				Description:     content,
+				Published:       published.Format(time.RFC3339),
+				PublishedParsed: &published,
+				Categories:      []string{"commit"},
+			}
+			if commit.Commit.Author.Name != "" {
+				item.Authors = []*gofeed.Person{{Name: commit.Commit.Author.Name}}
+			}
+
+			feed.Items = append(feed.Items, item)
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown kind %q", options.Kind)
+	}
+
+	return feed, nil
+}
+
+// renderGitHubMarkdown converts release notes and commit messages to HTML, like the content of any other item.
+func renderGitHubMarkdown(markdown string) string {
+	if markdown == "" {
+		return ""
+	}
+
+	var rendered bytes.Buffer
+	if err := githubMarkdown.Convert([]byte(markdown), &rendered); err != nil {
+		// Not worth losing the item over, show the source instead.
+		return "<pre>" + html.EscapeString(markdown) + "</pre>"
+	}
+
+	return rendered.String()
+}
+
+func (o GitHubSourceOptions) validate(field string, issues *ValidationError) (ok bool) {
+	ok = true
+
+	if o.Repository == "" {
+		issues.AddIssue(field+".repository", "repository is required")
+		ok = false
+	} else if !githubRepositoryPattern.MatchString(o.Repository) {
+		issues.AddIssue(field+".repository", "repository must be in the owner/repo format")
+		ok = false
+	}
+
+	switch o.Kind {
+	case "", GitHubReleases, GitHubTags:
+		if o.Branch != "" {
+			issues.AddIssue(field+".branch", "branch only applies to commits")
+			ok = false
+		}
+	case GitHubCommits:
+	default:
+		issues.AddIssue(field+".kind", "kind must be one of releases, tags, or commits")
+		ok = false
+	}
+
+	if o.IncludePrereleases && o.Kind != "" && o.Kind != GitHubReleases {
+		issues.AddIssue(field+".include_prereleases", "include_prereleases only applies to releases")
+		ok = false
+	}
+
+	if o.BaseURL != "" {
+		if u, err := url.Parse(o.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			issues.AddIssue(field+".base_url", "base_url must be an http(s) URL")
+			ok = false
+		}
+	}
+
+	return ok
+}
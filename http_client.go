@@ -0,0 +1,214 @@
+// Copyright 2024 Teknologi Umum <opensource@teknologiumum.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package brassite
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+type httpClientContextKey struct{}
+
+// IsEmpty returns true if nothing is configured, the default client is used then.
+func (o HTTPOptions) IsEmpty() bool {
+	return o == HTTPOptions{}
+}
+
+// Merge returns the options with the ones set in override taking precedence. Used to apply
+// the feed's HTTP options on top of the global ones.
+func (o HTTPOptions) Merge(override HTTPOptions) HTTPOptions {
+	if override.Timeout != 0 {
+		o.Timeout = override.Timeout
+	}
+	if override.ConnectTimeout != 0 {
+		o.ConnectTimeout = override.ConnectTimeout
+	}
+	if override.ReadTimeout != 0 {
+		o.ReadTimeout = override.ReadTimeout
+	}
+	if override.Proxy != nil {
+		o.Proxy = override.Proxy
+	}
+	if override.CAFile != "" {
+		o.CAFile = override.CAFile
+	}
+	if override.ClientCertificate != "" || override.ClientKey != "" {
+		o.ClientCertificate = override.ClientCertificate
+		o.ClientKey = override.ClientKey
+	}
+	if override.InsecureSkipVerify != nil {
+		o.InsecureSkipVerify = override.InsecureSkipVerify
+	}
+	if override.MaxRedirects != 0 {
+		o.MaxRedirects = override.MaxRedirects
+	}
+	return o
+}
+
+// NewHTTPClient creates an HTTP client from the options. Empty options give http.DefaultClient.
+func NewHTTPClient(options HTTPOptions) (*http.Client, error) {
+	if options.IsEmpty() {
+		return http.DefaultClient, nil
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if options.ConnectTimeout > 0 {
+		dialer := &net.Dialer{Timeout: options.ConnectTimeout, KeepAlive: 30 * time.Second}
+		transport.DialContext = dialer.DialContext
+		transport.TLSHandshakeTimeout = options.ConnectTimeout
+	}
+
+	if options.ReadTimeout > 0 {
+		transport.ResponseHeaderTimeout = options.ReadTimeout
+	}
+
+	switch {
+	case options.Proxy == nil:
+		// Keep the proxy of the environment variables.
+	case *options.Proxy == "":
+		transport.Proxy = nil
+	default:
+		// http.Transport speaks socks5 as well, no need for a separate dialer.
+		proxyURL, err := url.Parse(*options.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy url: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: options.InsecureSkipVerify != nil && *options.InsecureSkipVerify}
+
+	if options.CAFile != "" {
+		pem, err := os.ReadFile(options.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca file: %w", err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("ca file does not contain any PEM certificate")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if options.ClientCertificate != "" {
+		certificate, err := tls.LoadX509KeyPair(options.ClientCertificate, options.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	transport.TLSClientConfig = tlsConfig
+
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   options.Timeout,
+	}
+
+	switch {
+	case options.MaxRedirects < 0:
+		client.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	case options.MaxRedirects > 0:
+		client.CheckRedirect = func(_ *http.Request, via []*http.Request) error {
+			if len(via) > options.MaxRedirects {
+				return fmt.Errorf("stopped after %d redirects", options.MaxRedirects)
+			}
+			return nil
+		}
+	}
+
+	return client, nil
+}
+
+// WithHTTPClient returns a context carrying the HTTP client, every request made by brassite
+// with that context (fetching the feed, delivering to Discord, etc.) goes through it. Feeds are
+// fetched with their own client, deliveries get the global one: a feed's proxy or relaxed TLS
+// settings must not apply to requests carrying webhook tokens and passwords.
+func WithHTTPClient(ctx context.Context, client *http.Client) context.Context {
+	return context.WithValue(ctx, httpClientContextKey{}, client)
+}
+
+// HTTPClientFromContext returns the client set by WithHTTPClient, or http.DefaultClient.
+func HTTPClientFromContext(ctx context.Context) *http.Client {
+	if client, ok := ctx.Value(httpClientContextKey{}).(*http.Client); ok && client != nil {
+		return client
+	}
+	return http.DefaultClient
+}
+
+// validate checks the options without creating a client, field is the path of the options
+// in the configuration file.
+func (o HTTPOptions) validate(field string, issues *ValidationError) (ok bool) {
+	ok = true
+
+	if o.Timeout < 0 || o.ConnectTimeout < 0 || o.ReadTimeout < 0 {
+		issues.AddIssue(field, "timeouts can't be negative")
+		ok = false
+	}
+
+	if o.Proxy != nil && *o.Proxy != "" {
+		u, err := url.Parse(*o.Proxy)
+		if err != nil || u.Host == "" {
+			issues.AddIssue(field+".proxy", "proxy must be a valid URL")
+			ok = false
+		} else if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5" && u.Scheme != "socks5h" {
+			issues.AddIssue(field+".proxy", "proxy scheme must be one of http, https, socks5, or socks5h")
+			ok = false
+		}
+	}
+
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			issues.AddIssue(field+".ca_file", fmt.Sprintf("failed to read ca file: %s", err.Error()))
+			ok = false
+		} else if !x509.NewCertPool().AppendCertsFromPEM(pem) {
+			issues.AddIssue(field+".ca_file", "ca file does not contain any PEM certificate")
+			ok = false
+		}
+	}
+
+	if (o.ClientCertificate == "") != (o.ClientKey == "") {
+		issues.AddIssue(field+".client_certificate", "client_certificate and client_key must be set together")
+		ok = false
+	} else if o.ClientCertificate != "" {
+		if _, err := tls.LoadX509KeyPair(o.ClientCertificate, o.ClientKey); err != nil {
+			issues.AddIssue(field+".client_certificate", fmt.Sprintf("failed to load client certificate: %s", err.Error()))
+			ok = false
+		}
+	}
+
+	if o.MaxRedirects < -1 {
+		issues.AddIssue(field+".max_redirects", "max_redirects must be -1 (don't follow redirects) or greater")
+		ok = false
+	}
+
+	return
+}
@@ -0,0 +1,122 @@
+// Copyright 2024 Teknologi Umum <opensource@teknologiumum.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package brassite
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+)
+
+// ItemEnvironment is what a `when` expression sees, e.g.
+// `title contains "Go" and weekday not in ["Saturday", "Sunday"] and "bot" not in authors`.
+type ItemEnvironment struct {
+	Title      string    `expr:"title"`
+	Content    string    `expr:"content"`
+	URL        string    `expr:"url"`
+	GUID       string    `expr:"guid"`
+	Image      string    `expr:"image"`
+	Categories []string  `expr:"categories"`
+	Authors    []string  `expr:"authors"`
+	Published  time.Time `expr:"published"`
+	// Weekday of the publish date in English (e.g. "Monday"), empty if the feed doesn't provide one
+	Weekday string `expr:"weekday"`
+	// Hour of the publish date (0-23), in the time zone the feed gives
+	Hour int             `expr:"hour"`
+	Feed FeedEnvironment `expr:"feed"`
+}
+
+// FeedEnvironment is the feed metadata available as `feed` in a `when` expression.
+type FeedEnvironment struct {
+	Name        string `expr:"name"`
+	Title       string `expr:"title"`
+	Description string `expr:"description"`
+	URL         string `expr:"url"`
+}
+
+// Compiled expressions, so we don't compile them again for every item.
+var itemExpressions sync.Map
+
+// NewItemEnvironment exposes the feed item to an expression.
+func NewItemEnvironment(feedItem FeedItem) ItemEnvironment {
+	env := ItemEnvironment{
+		Title:      feedItem.ItemTitle,
+		Content:    feedItem.ItemDescription,
+		URL:        feedItem.ItemURL,
+		GUID:       feedItem.ItemGUID,
+		Image:      feedItem.ItemImage,
+		Categories: feedItem.ItemCategories,
+		Authors:    feedItem.ItemAuthors,
+		Published:  feedItem.ItemPublished,
+		Feed: FeedEnvironment{
+			Name:        feedItem.FeedName,
+			Title:       feedItem.ChannelTitle,
+			Description: feedItem.ChannelDescription,
+			URL:         feedItem.ChannelURL,
+		},
+	}
+
+	if env.Categories == nil {
+		env.Categories = []string{}
+	}
+	if env.Authors == nil {
+		env.Authors = []string{}
+	}
+	if !feedItem.ItemPublished.IsZero() {
+		env.Weekday = feedItem.ItemPublished.Weekday().String()
+		env.Hour = feedItem.ItemPublished.Hour()
+	}
+
+	return env
+}
+
+// CompileItemExpression type checks the expression against ItemEnvironment, it must evaluate to a boolean.
+func CompileItemExpression(expression string) (*vm.Program, error) {
+	if program, ok := itemExpressions.Load(expression); ok {
+		return program.(*vm.Program), nil
+	}
+
+	if strings.TrimSpace(expression) == "" {
+		return nil, fmt.Errorf("expression is empty")
+	}
+
+	program, err := expr.Compile(expression, expr.Env(ItemEnvironment{}), expr.AsBool())
+	if err != nil {
+		return nil, err
+	}
+
+	itemExpressions.Store(expression, program)
+	return program, nil
+}
+
+// EvaluateItemExpression returns the result of the expression for the feed item.
+func EvaluateItemExpression(expression string, feedItem FeedItem) (bool, error) {
+	program, err := CompileItemExpression(expression)
+	if err != nil {
+		return false, fmt.Errorf("failed to compile expression: %w", err)
+	}
+
+	result, err := expr.Run(program, NewItemEnvironment(feedItem))
+	if err != nil {
+		return false, fmt.Errorf("failed to evaluate expression: %w", err)
+	}
+
+	matched, _ := result.(bool)
+	return matched, nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2024 Teknologi Umum <opensource@teknologiumum.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package brassite
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// ItemMatcher decides whether a feed item matches a set of criteria. Within a criterion,
+// any value may match (e.g. any of the keywords), but every criterion that is set must
+// match for the item to match. An empty matcher matches nothing.
+type ItemMatcher struct {
+	// Keywords are matched case-insensitively against the title and the content
+	Keywords []string `json:"keywords" yaml:"keywords" toml:"keywords"`
+	// Regex is matched against the title and the content
+	Regex string `json:"regex" yaml:"regex" toml:"regex"`
+	// Categories are matched case-insensitively against the item categories
+	Categories []string `json:"categories" yaml:"categories" toml:"categories"`
+}
+
+// Compiled regular expressions, so we don't compile them again for every item.
+var itemMatcherRegexes sync.Map
+
+// IsEmpty returns true if no criteria is set.
+func (m ItemMatcher) IsEmpty() bool {
+	return len(m.Keywords) == 0 && m.Regex == "" && len(m.Categories) == 0
+}
+
+// Validate checks the regular expression, it returns nil for a valid matcher.
+func (m ItemMatcher) Validate() error {
+	if m.Regex == "" {
+		return nil
+	}
+
+	_, err := regexp.Compile(m.Regex)
+	if err != nil {
+		return fmt.Errorf("invalid regex: %w", err)
+	}
+
+	return nil
+}
+
+// Match returns true if the item matches every criteria that is set.
+func (m ItemMatcher) Match(feedItem FeedItem) bool {
+	if m.IsEmpty() {
+		return false
+	}
+
+	if len(m.Keywords) > 0 {
+		title := strings.ToLower(feedItem.ItemTitle)
+		content := strings.ToLower(feedItem.ItemDescription)
+
+		found := false
+		for _, keyword := range m.Keywords {
+			keyword = strings.ToLower(keyword)
+			if strings.Contains(title, keyword) || strings.Contains(content, keyword) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	if m.Regex != "" {
+		pattern, err := m.compile()
+		if err != nil {
+			return false
+		}
+
+		if !pattern.MatchString(feedItem.ItemTitle) && !pattern.MatchString(feedItem.ItemDescription) {
+			return false
+		}
+	}
+
+	if len(m.Categories) > 0 {
+		found := false
+		for _, category := range m.Categories {
+			for _, itemCategory := range feedItem.ItemCategories {
+				if strings.EqualFold(strings.TrimSpace(itemCategory), category) {
+					found = true
+					break
+				}
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (m ItemMatcher) compile() (*regexp.Regexp, error) {
+	if pattern, ok := itemMatcherRegexes.Load(m.Regex); ok {
+		return pattern.(*regexp.Regexp), nil
+	}
+
+	pattern, err := regexp.Compile(m.Regex)
+	if err != nil {
+		return nil, err
+	}
+
+	itemMatcherRegexes.Store(m.Regex, pattern)
+	return pattern, nil
+}
@@ -0,0 +1,66 @@
+// Copyright 2024 Teknologi Umum <opensource@teknologiumum.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package brassite
+
+import "sync"
+
+// Queueing and taking items is a read-modify-write on the state, serialize it.
+var itemQueueMu sync.Mutex
+
+// enqueueItem appends the feed item to the queue stored under bucket/key. An item that is
+// already queued (same GUID) is replaced with the newer version.
+func enqueueItem(state *StateStore, bucket string, key string, feedItem FeedItem) error {
+	itemQueueMu.Lock()
+	defer itemQueueMu.Unlock()
+
+	var items []FeedItem
+	_, err := state.Get(bucket, key, &items)
+	if err != nil {
+		return err
+	}
+
+	replaced := false
+	for i, item := range items {
+		if feedItem.ItemGUID != "" && item.ItemGUID == feedItem.ItemGUID {
+			items[i] = feedItem
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		items = append(items, feedItem)
+	}
+
+	return state.Put(bucket, key, items, 0)
+}
+
+// takeQueuedItems returns the items queued under bucket/key and clears the queue.
+func takeQueuedItems(state *StateStore, bucket string, key string) ([]FeedItem, error) {
+	itemQueueMu.Lock()
+	defer itemQueueMu.Unlock()
+
+	var items []FeedItem
+	_, err := state.Get(bucket, key, &items)
+	if err != nil {
+		return nil, err
+	}
+
+	err = state.Delete(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
@@ -0,0 +1,334 @@
+// Copyright 2024 Teknologi Umum <opensource@teknologiumum.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package brassite
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+	"github.com/mmcdole/gofeed"
+)
+
+// Compiled JSON source expressions, so we don't compile them again for every item.
+var jsonSourceExpressions sync.Map
+
+// ExtractJSONFeed extracts the items of the JSON API response with the expressions of options.
+// The result has the same shape as a parsed feed, so the items go through the same filters and
+// deliveries. Relative URLs are resolved against sourceURL. One odd item doesn't hold back the
+// others: an item that can't be extracted is skipped, and an item whose date can't be parsed
+// is kept without a date, their errors are returned in warnings.
+func ExtractJSONFeed(sourceURL string, body []byte, options JSONSourceOptions) (feed *gofeed.Feed, warnings []error, err error) {
+	base, err := url.Parse(sourceURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid source url: %w", err)
+	}
+
+	location := time.UTC
+	if options.TimeZone != "" {
+		location, err = time.LoadLocation(options.TimeZone)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unknown time zone %q: %w", options.TimeZone, err)
+		}
+	}
+
+	// Numbers are decoded as json.Number, float64 would round IDs past 2^53.
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	var response any
+	if err := decoder.Decode(&response); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse JSON: %w", err)
+	}
+	response = jsonNumbers(response)
+
+	list := response
+	if options.Items != "" {
+		list, err = evaluateJSONSourceExpression(options.Items, response)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to evaluate items: %w", err)
+		}
+	}
+
+	values, ok := list.([]any)
+	if !ok {
+		return nil, nil, fmt.Errorf("items must be an array, got %T", list)
+	}
+
+	feed = &gofeed.Feed{
+		Link:     sourceURL,
+		FeedLink: sourceURL,
+		FeedType: "json_api",
+	}
+
+	for i, value := range values {
+		item, err := extractJSONItem(value, options, base)
+		if err != nil {
+			warnings = append(warnings, fmt.Errorf("item %d: %w", i, err))
+			continue
+		}
+
+		if item.Title == "" {
+			continue
+		}
+
+		if err := setJSONItemDate(item, value, options, location); err != nil {
+			// The item is still delivered, dated when it's first seen.
+			warnings = append(warnings, fmt.Errorf("item %d: %w", i, err))
+		}
+
+		feed.Items = append(feed.Items, item)
+	}
+
+	return feed, warnings, nil
+}
+
+func extractJSONItem(value any, options JSONSourceOptions, base *url.URL) (*gofeed.Item, error) {
+	if _, ok := value.(map[string]any); !ok {
+		return nil, fmt.Errorf("item must be an object, got %T", value)
+	}
+
+	fields := map[string]string{
+		"title":   options.Title,
+		"url":     options.URL,
+		"id":      options.ID,
+		"content": options.Content,
+	}
+	results := make(map[string]any, len(fields))
+	for name, expression := range fields {
+		if expression == "" {
+			continue
+		}
+
+		result, err := evaluateJSONSourceExpression(expression, value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to evaluate %s: %w", name, err)
+		}
+		results[name] = result
+	}
+
+	item := &gofeed.Item{
+		Title:   strings.Join(strings.Fields(jsonString(results["title"])), " "),
+		Content: jsonString(results["content"]),
+	}
+	item.Description = item.Content
+	item.Link = resolveItemURL(base, jsonString(results["url"]))
+
+	item.GUID = jsonString(results["id"])
+	if item.GUID == "" {
+		item.GUID = item.Link
+	}
+	if item.GUID == "" {
+		item.GUID = item.Title
+	}
+
+	return item, nil
+}
+
+// setJSONItemDate sets the published date of the item, it's left empty on error.
+func setJSONItemDate(item *gofeed.Item, value any, options JSONSourceOptions, location *time.Location) error {
+	if options.Date == "" {
+		return nil
+	}
+
+	date, err := evaluateJSONSourceExpression(options.Date, value)
+	if err != nil {
+		return fmt.Errorf("failed to evaluate the date of %q: %w", item.Title, err)
+	}
+
+	published, err := jsonDate(date, options.DateFormat, location)
+	if err != nil {
+		return fmt.Errorf("failed to parse the date of %q: %w", item.Title, err)
+	}
+	if !published.IsZero() {
+		item.PublishedParsed = &published
+		item.Published = jsonString(date)
+	}
+
+	return nil
+}
+
+func compileJSONSourceExpression(expression string) (*vm.Program, error) {
+	if program, ok := jsonSourceExpressions.Load(expression); ok {
+		return program.(*vm.Program), nil
+	}
+
+	program, err := expr.Compile(expression, expr.AllowUndefinedVariables())
+	if err != nil {
+		return nil, err
+	}
+
+	jsonSourceExpressions.Store(expression, program)
+	return program, nil
+}
+
+// evaluateJSONSourceExpression evaluates the expression with the fields of value as variables.
+func evaluateJSONSourceExpression(expression string, value any) (any, error) {
+	program, err := compileJSONSourceExpression(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	env, ok := value.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("expected an object, got %T", value)
+	}
+
+	return expr.Run(program, env)
+}
+
+// jsonNumbers turns the json.Number values into int64 when they're integers that fit, float64
+// otherwise, so expressions can compare and compute with them. Integers too big for int64 are
+// left as json.Number.
+func jsonNumbers(value any) any {
+	switch value := value.(type) {
+	case json.Number:
+		if n, err := value.Int64(); err == nil {
+			return n
+		}
+		if strings.ContainsAny(string(value), ".eE") {
+			if f, err := value.Float64(); err == nil {
+				return f
+			}
+		}
+		return value
+	case []any:
+		for i := range value {
+			value[i] = jsonNumbers(value[i])
+		}
+		return value
+	case map[string]any:
+		for key := range value {
+			value[key] = jsonNumbers(value[key])
+		}
+		return value
+	default:
+		return value
+	}
+}
+
+// jsonString formats a JSON value for an item field, numbers without an exponent
+// so large IDs stay intact.
+func jsonString(value any) string {
+	switch value := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return strings.TrimSpace(value)
+	case json.Number:
+		return value.String()
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case int:
+		return strconv.Itoa(value)
+	case int64:
+		return strconv.FormatInt(value, 10)
+	case bool:
+		return strconv.FormatBool(value)
+	default:
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Sprint(value)
+		}
+		return string(encoded)
+	}
+}
+
+// jsonDate parses a date string or a Unix timestamp, in seconds or milliseconds.
+func jsonDate(value any, layout string, location *time.Location) (time.Time, error) {
+	switch value := value.(type) {
+	case nil:
+		return time.Time{}, nil
+	case float64:
+		// Timestamps in milliseconds are past the year 33658 in seconds.
+		if math.Abs(value) >= 1e12 {
+			return time.UnixMilli(int64(value)).UTC(), nil
+		}
+		return time.Unix(int64(value), 0).UTC(), nil
+	case int:
+		return jsonDate(int64(value), layout, location)
+	case int64:
+		if value >= 1e12 || value <= -1e12 {
+			return time.UnixMilli(value).UTC(), nil
+		}
+		return time.Unix(value, 0).UTC(), nil
+	case json.Number:
+		timestamp, err := value.Float64()
+		if err != nil {
+			return time.Time{}, fmt.Errorf("unexpected date %v", value)
+		}
+		return jsonDate(timestamp, layout, location)
+	case string:
+		value = strings.TrimSpace(value)
+		if value == "" {
+			return time.Time{}, nil
+		}
+		return parseItemDate(value, layout, location)
+	default:
+		return time.Time{}, fmt.Errorf("unexpected date %v (%T)", value, value)
+	}
+}
+
+func (o JSONSourceOptions) validate(field string, issues *ValidationError) (ok bool) {
+	ok = true
+
+	if o.Title == "" {
+		issues.AddIssue(field+".title", "title is required")
+		ok = false
+	}
+
+	expressions := []struct {
+		name       string
+		expression string
+	}{
+		{"items", o.Items},
+		{"id", o.ID},
+		{"title", o.Title},
+		{"url", o.URL},
+		{"date", o.Date},
+		{"content", o.Content},
+	}
+	for _, e := range expressions {
+		if e.expression == "" {
+			continue
+		}
+		if _, err := compileJSONSourceExpression(e.expression); err != nil {
+			issues.AddIssue(field+"."+e.name, fmt.Sprintf("invalid expression: %s", err.Error()))
+			ok = false
+		}
+	}
+
+	if o.DateFormat != "" && o.Date == "" {
+		issues.AddIssue(field+".date_format", "date_format requires date")
+		ok = false
+	}
+
+	if o.TimeZone != "" {
+		if _, err := time.LoadLocation(o.TimeZone); err != nil {
+			issues.AddIssue(field+".time_zone", fmt.Sprintf("unknown time zone %q", o.TimeZone))
+			ok = false
+		}
+	}
+
+	return ok
+}
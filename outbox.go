@@ -0,0 +1,242 @@
+// Copyright 2024 Teknologi Umum <opensource@teknologiumum.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package brassite
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	outboxBucket      = "outbox"
+	deadLettersBucket = "dead_letters"
+)
+
+// DefaultOutboxMaxAttempts is used when OutboxOptions.MaxAttempts is not set.
+const DefaultOutboxMaxAttempts = 8
+
+// Retries back off exponentially from outboxBaseBackoff, up to outboxMaxBackoff.
+const (
+	outboxBaseBackoff = 30 * time.Second
+	outboxMaxBackoff  = time.Hour
+)
+
+// OutboxEntry is a single delivery of a feed item to one target of a feed.
+type OutboxEntry struct {
+	ID       string   `json:"id"`
+	FeedName string   `json:"feed_name"`
+	Target   string   `json:"target"`
+	Item     FeedItem `json:"item"`
+	// Attempts made so far
+	Attempts      int       `json:"attempts"`
+	CreatedAt     time.Time `json:"created_at"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+	LastError     string    `json:"last_error,omitempty"`
+}
+
+// Outbox records every item-to-target delivery in the state store until it succeeds. Failed
+// deliveries are retried with a backoff, and moved to the dead-letter list after too many attempts.
+type Outbox struct {
+	state       *StateStore
+	maxAttempts int
+
+	// Entries currently being delivered, so the dispatcher and the worker don't deliver
+	// the same entry twice at the same time.
+	mu       sync.Mutex
+	inFlight map[string]struct{}
+}
+
+func NewOutbox(state *StateStore, maxAttempts int) *Outbox {
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultOutboxMaxAttempts
+	}
+
+	return &Outbox{
+		state:       state,
+		maxAttempts: maxAttempts,
+		inFlight:    make(map[string]struct{}),
+	}
+}
+
+// Add records a new delivery. The returned entry is claimed, the caller is expected to
+// attempt it and report the result with Succeeded or Failed.
+func (o *Outbox) Add(feedName string, target string, feedItem FeedItem) (OutboxEntry, error) {
+	id, err := newOutboxID()
+	if err != nil {
+		return OutboxEntry{}, err
+	}
+
+	now := time.Now().UTC()
+	entry := OutboxEntry{
+		ID:            id,
+		FeedName:      feedName,
+		Target:        target,
+		Item:          feedItem,
+		CreatedAt:     now,
+		NextAttemptAt: now,
+	}
+
+	o.mu.Lock()
+	o.inFlight[id] = struct{}{}
+	o.mu.Unlock()
+
+	err = o.state.Put(outboxBucket, id, entry, 0)
+	if err != nil {
+		o.release(id)
+		return OutboxEntry{}, err
+	}
+
+	return entry, nil
+}
+
+// Due claims and returns the entries whose next attempt is due, oldest first.
+func (o *Outbox) Due(now time.Time) ([]OutboxEntry, error) {
+	var due []OutboxEntry
+	for _, id := range o.state.Keys(outboxBucket) {
+		var entry OutboxEntry
+		found, err := o.state.Get(outboxBucket, id, &entry)
+		if err != nil {
+			return nil, err
+		}
+		if !found || entry.NextAttemptAt.After(now) {
+			continue
+		}
+
+		o.mu.Lock()
+		_, claimed := o.inFlight[id]
+		if !claimed {
+			o.inFlight[id] = struct{}{}
+		}
+		o.mu.Unlock()
+
+		if !claimed {
+			due = append(due, entry)
+		}
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].CreatedAt.Before(due[j].CreatedAt)
+	})
+
+	return due, nil
+}
+
+// Succeeded removes the delivered entry.
+func (o *Outbox) Succeeded(entry OutboxEntry) error {
+	defer o.release(entry.ID)
+	return o.state.Delete(outboxBucket, entry.ID)
+}
+
+// Failed records the failed attempt and schedules the next one. It returns true when the
+// entry ran out of attempts and was moved to the dead-letter list.
+func (o *Outbox) Failed(entry OutboxEntry, deliveryErr error) (deadLettered bool, err error) {
+	defer o.release(entry.ID)
+
+	entry.Attempts++
+	entry.LastError = deliveryErr.Error()
+
+	if entry.Attempts >= o.maxAttempts {
+		err = o.state.Put(deadLettersBucket, entry.ID, entry, 0)
+		if err != nil {
+			return false, err
+		}
+		return true, o.state.Delete(outboxBucket, entry.ID)
+	}
+
+	backoff := outboxBaseBackoff << (entry.Attempts - 1)
+	if backoff > outboxMaxBackoff || backoff <= 0 {
+		backoff = outboxMaxBackoff
+	}
+	entry.NextAttemptAt = time.Now().UTC().Add(backoff)
+
+	return false, o.state.Put(outboxBucket, entry.ID, entry, 0)
+}
+
+func (o *Outbox) release(id string) {
+	o.mu.Lock()
+	delete(o.inFlight, id)
+	o.mu.Unlock()
+}
+
+// DeadLetters returns the entries that ran out of attempts, oldest first.
+func (o *Outbox) DeadLetters() ([]OutboxEntry, error) {
+	var entries []OutboxEntry
+	for _, id := range o.state.Keys(deadLettersBucket) {
+		var entry OutboxEntry
+		found, err := o.state.Get(deadLettersBucket, id, &entry)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			entries = append(entries, entry)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].CreatedAt.Before(entries[j].CreatedAt)
+	})
+
+	return entries, nil
+}
+
+// RetryDeadLetter moves the dead-lettered entry back to the outbox with its attempts reset,
+// so the dispatcher picks it up again.
+func (o *Outbox) RetryDeadLetter(id string) error {
+	var entry OutboxEntry
+	found, err := o.state.Get(deadLettersBucket, id, &entry)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("dead letter %s not found", id)
+	}
+
+	entry.Attempts = 0
+	entry.NextAttemptAt = time.Now().UTC()
+
+	err = o.state.Put(outboxBucket, id, entry, 0)
+	if err != nil {
+		return err
+	}
+
+	return o.state.Delete(deadLettersBucket, id)
+}
+
+// PurgeDeadLetter drops the dead-lettered entry for good.
+func (o *Outbox) PurgeDeadLetter(id string) error {
+	var entry OutboxEntry
+	found, err := o.state.Get(deadLettersBucket, id, &entry)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("dead letter %s not found", id)
+	}
+
+	return o.state.Delete(deadLettersBucket, id)
+}
+
+func newOutboxID() (string, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate outbox id: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,283 @@
+// Copyright 2024 Teknologi Umum <opensource@teknologiumum.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package brassite
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+	"github.com/mmcdole/gofeed/rss"
+	"github.com/titanous/json5"
+)
+
+// Bounds of `interval: auto` when Feed.MinInterval and Feed.MaxInterval are not set.
+const (
+	DefaultMinPollInterval = 5 * time.Minute
+	DefaultMaxPollInterval = 24 * time.Hour
+)
+
+// Only the most recent items tell how often the feed is updated nowadays.
+const pollCadenceItems = 20
+
+// FeedInterval is how often a feed is checked: a duration (e.g. `1h`), or `auto` to adapt it
+// to the hints given by the feed and to how often it publishes, see NextPollInterval.
+type FeedInterval struct {
+	time.Duration
+	Auto bool
+}
+
+// PollHints are what the feed tells about how often it should be checked.
+type PollHints struct {
+	// TTL is the RSS `<ttl>`
+	TTL time.Duration
+	// UpdatePeriod comes from `sy:updatePeriod` and `sy:updateFrequency`
+	UpdatePeriod time.Duration
+	// MaxAge is the `max-age` of the Cache-Control response header
+	MaxAge time.Duration
+	// SkipHours (in GMT) and SkipDays are the RSS `<skipHours>` and `<skipDays>`
+	SkipHours []int
+	SkipDays  []time.Weekday
+}
+
+func (i FeedInterval) String() string {
+	if i.Auto {
+		return "auto"
+	}
+	return i.Duration.String()
+}
+
+func (i *FeedInterval) parse(value any) error {
+	switch v := value.(type) {
+	case string:
+		if strings.EqualFold(strings.TrimSpace(v), "auto") {
+			*i = FeedInterval{Auto: true}
+			return nil
+		}
+		duration, err := time.ParseDuration(v)
+		if err != nil {
+			// Plain numbers are nanoseconds, same as a time.Duration.
+			nanoseconds, intErr := strconv.ParseInt(v, 10, 64)
+			if intErr != nil {
+				return fmt.Errorf("invalid interval %q, should be a duration (e.g. 1h) or auto", v)
+			}
+			duration = time.Duration(nanoseconds)
+		}
+		*i = FeedInterval{Duration: duration}
+	case int64:
+		*i = FeedInterval{Duration: time.Duration(v)}
+	case float64:
+		*i = FeedInterval{Duration: time.Duration(v)}
+	default:
+		return fmt.Errorf("invalid interval %v, should be a duration (e.g. 1h) or auto", value)
+	}
+	return nil
+}
+
+func (i *FeedInterval) UnmarshalYAML(unmarshal func(any) error) error {
+	var value string
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	return i.parse(value)
+}
+
+func (i *FeedInterval) UnmarshalJSON(data []byte) error {
+	var value any
+	if err := json5.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	return i.parse(value)
+}
+
+func (i *FeedInterval) UnmarshalTOML(data any) error {
+	return i.parse(data)
+}
+
+// PollIntervalBounds returns the bounds of `interval: auto`, with the defaults applied.
+func (f Feed) PollIntervalBounds() (min time.Duration, max time.Duration) {
+	min, max = f.MinInterval, f.MaxInterval
+	if min <= 0 {
+		min = DefaultMinPollInterval
+	}
+	if max <= 0 {
+		max = DefaultMaxPollInterval
+	}
+	if max < min {
+		max = min
+	}
+	return min, max
+}
+
+// NewPollHints collects the hints from the parsed feed, the RSS channel when the feed is an
+// RSS feed (gofeed doesn't carry ttl and skip* over), and the Cache-Control response header.
+func NewPollHints(feed *gofeed.Feed, channel *rss.Feed, cacheControl string) PollHints {
+	var hints PollHints
+
+	if channel != nil {
+		if minutes, err := strconv.Atoi(strings.TrimSpace(channel.TTL)); err == nil && minutes > 0 {
+			hints.TTL = time.Duration(minutes) * time.Minute
+		}
+		for _, hour := range channel.SkipHours {
+			if h, err := strconv.Atoi(strings.TrimSpace(hour)); err == nil && h >= 0 && h < 24 {
+				hints.SkipHours = append(hints.SkipHours, h)
+			}
+		}
+		for _, day := range channel.SkipDays {
+			if weekday, ok := weekdays[strings.ToLower(strings.TrimSpace(day))]; ok {
+				hints.SkipDays = append(hints.SkipDays, weekday)
+			}
+		}
+	}
+
+	if feed != nil {
+		hints.UpdatePeriod = syndicationUpdatePeriod(feed)
+	}
+
+	for _, directive := range strings.Split(cacheControl, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if strings.EqualFold(name, "max-age") {
+			if seconds, err := strconv.Atoi(strings.Trim(value, `"`)); err == nil && seconds > 0 {
+				hints.MaxAge = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+
+	return hints
+}
+
+// syndicationUpdatePeriod reads the RSS 1.0 syndication module, e.g. an updatePeriod of
+// "hourly" with an updateFrequency of 2 means the feed is updated every 30 minutes.
+func syndicationUpdatePeriod(feed *gofeed.Feed) time.Duration {
+	sy, ok := feed.Extensions["sy"]
+	if !ok {
+		return 0
+	}
+
+	var period time.Duration
+	if values := sy["updatePeriod"]; len(values) > 0 {
+		switch strings.ToLower(strings.TrimSpace(values[0].Value)) {
+		case "hourly":
+			period = time.Hour
+		case "daily":
+			period = 24 * time.Hour
+		case "weekly":
+			period = 7 * 24 * time.Hour
+		case "monthly":
+			period = 30 * 24 * time.Hour
+		case "yearly":
+			period = 365 * 24 * time.Hour
+		}
+	}
+	if period == 0 {
+		return 0
+	}
+
+	if values := sy["updateFrequency"]; len(values) > 0 {
+		if frequency, err := strconv.Atoi(strings.TrimSpace(values[0].Value)); err == nil && frequency > 0 {
+			period /= time.Duration(frequency)
+		}
+	}
+
+	return period
+}
+
+// NextPollInterval picks how long to wait before checking the feed again. The feed's own hints
+// win when there are some. Otherwise the feed is checked twice per average gap between its
+// recent items, and less and less often as its newest item gets older. The result is kept
+// between min and max, then pushed past the hours and days the feed asks to skip.
+func NextPollInterval(hints PollHints, published []time.Time, min time.Duration, max time.Duration, now time.Time) time.Duration {
+	interval := hints.TTL
+	if hints.UpdatePeriod > interval {
+		interval = hints.UpdatePeriod
+	}
+	if hints.MaxAge > interval {
+		interval = hints.MaxAge
+	}
+
+	if interval == 0 {
+		interval = publishCadence(published, now, max)
+	}
+
+	if interval < min {
+		interval = min
+	}
+	if interval > max {
+		interval = max
+	}
+
+	return skipPollHours(hints, now, interval)
+}
+
+func publishCadence(published []time.Time, now time.Time, max time.Duration) time.Duration {
+	times := make([]time.Time, 0, len(published))
+	for _, t := range published {
+		if !t.IsZero() && !t.After(now) {
+			times = append(times, t)
+		}
+	}
+
+	// Not enough items to tell, the feed is probably not very active.
+	if len(times) < 2 {
+		return max
+	}
+
+	sort.Slice(times, func(i, j int) bool { return times[i].After(times[j]) })
+	if len(times) > pollCadenceItems {
+		times = times[:pollCadenceItems]
+	}
+
+	averageGap := times[0].Sub(times[len(times)-1]) / time.Duration(len(times)-1)
+	interval := averageGap / 2
+
+	// A feed that stopped publishing is checked less often the longer it stays quiet.
+	if quiet := now.Sub(times[0]); quiet > averageGap {
+		interval = quiet / 2
+	}
+
+	return interval
+}
+
+// skipPollHours delays the poll until it's outside of the skipped hours and days.
+func skipPollHours(hints PollHints, now time.Time, interval time.Duration) time.Duration {
+	if len(hints.SkipHours) == 0 && len(hints.SkipDays) == 0 {
+		return interval
+	}
+
+	next := now.Add(interval).UTC()
+	// A week is enough to go through every hour of every day.
+	for i := 0; i < 7*24 && isSkipped(hints, next); i++ {
+		next = next.Truncate(time.Hour).Add(time.Hour)
+	}
+
+	return next.Sub(now)
+}
+
+func isSkipped(hints PollHints, t time.Time) bool {
+	for _, hour := range hints.SkipHours {
+		if t.Hour() == hour {
+			return true
+		}
+	}
+	for _, day := range hints.SkipDays {
+		if t.Weekday() == day {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,282 @@
+// Copyright 2024 Teknologi Umum <opensource@teknologiumum.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package brassite
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/andybalholm/cascadia"
+	"github.com/mmcdole/gofeed"
+)
+
+// Tried in order when no date format is configured, roughly from the most to the least precise.
+var itemDateLayouts = []string{
+	time.RFC3339,
+	time.RFC1123Z,
+	time.RFC1123,
+	time.RFC822Z,
+	time.RFC822,
+	time.DateTime,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04",
+	time.DateOnly,
+	"2006/01/02",
+	"January 2, 2006",
+	"Jan 2, 2006",
+	"January 2 2006",
+	"Jan 2 2006",
+	"2 January 2006",
+	"2 Jan 2006",
+	"02 Jan 2006",
+	"Monday, January 2, 2006",
+	"Mon, January 2, 2006",
+	"Mon, Jan 2, 2006",
+}
+
+var scrapeAttributePattern = regexp.MustCompile(`^(.*?)@([A-Za-z_:][-A-Za-z0-9_:.]*)$`)
+
+// ScrapeFeed extracts the items of the HTML page with the CSS selectors of options. The result has
+// the same shape as a parsed feed, so scraped items go through the same filters and deliveries.
+// Relative links are resolved against pageURL (or the page's <base>). An item whose date can't be
+// parsed is kept without a date, the error is returned in undated.
+func ScrapeFeed(pageURL string, body []byte, options ScrapeOptions) (feed *gofeed.Feed, undated []error, err error) {
+	base, err := url.Parse(pageURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid page url: %w", err)
+	}
+
+	location := time.UTC
+	if options.TimeZone != "" {
+		location, err = time.LoadLocation(options.TimeZone)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unknown time zone %q: %w", options.TimeZone, err)
+		}
+	}
+
+	document, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse HTML: %w", err)
+	}
+
+	if href, ok := document.Find("base[href]").First().Attr("href"); ok {
+		if baseHref, err := base.Parse(strings.TrimSpace(href)); err == nil {
+			base = baseHref
+		}
+	}
+
+	description, _ := document.Find(`meta[name="description"]`).First().Attr("content")
+	feed = &gofeed.Feed{
+		Title:       strings.TrimSpace(document.Find("title").First().Text()),
+		Description: strings.TrimSpace(description),
+		Link:        pageURL,
+		FeedLink:    pageURL,
+		FeedType:    "scrape",
+	}
+
+	document.Find(options.Item).Each(func(_ int, element *goquery.Selection) {
+		title := strings.Join(strings.Fields(scrapeValue(element, options.Title, "")), " ")
+		if title == "" {
+			return
+		}
+
+		item := &gofeed.Item{Title: title}
+
+		link := ""
+		if options.Link != "" {
+			link = scrapeValue(element, options.Link, "href")
+		} else if element.Is("a[href]") {
+			link, _ = element.Attr("href")
+		} else {
+			link, _ = element.Find("a[href]").First().Attr("href")
+		}
+		item.Link = resolveItemURL(base, link)
+
+		if options.Date != "" {
+			date := strings.TrimSpace(scrapeValue(element, options.Date, "datetime"))
+			if date != "" {
+				published, err := parseItemDate(date, options.DateFormat, location)
+				if err != nil {
+					// The item is still delivered, dated when it's first seen.
+					undated = append(undated, fmt.Errorf("failed to parse the date of %q: %w", title, err))
+				} else {
+					item.PublishedParsed = &published
+					item.Published = date
+				}
+			}
+		}
+
+		if options.Content != "" {
+			item.Content = scrapeHTML(element, options.Content)
+			item.Description = item.Content
+		}
+
+		if options.Image != "" {
+			if image := resolveItemURL(base, scrapeValue(element, options.Image, "src")); image != "" {
+				item.Image = &gofeed.Image{URL: image}
+			}
+		}
+
+		item.GUID = item.Link
+		if item.GUID == "" {
+			item.GUID = title
+		}
+
+		feed.Items = append(feed.Items, item)
+	})
+
+	return feed, undated, nil
+}
+
+// splitScrapeSelector splits `selector@attribute` in its parts, the attribute is empty if there's none.
+func splitScrapeSelector(selector string) (string, string) {
+	if matches := scrapeAttributePattern.FindStringSubmatch(selector); matches != nil {
+		return strings.TrimSpace(matches[1]), matches[2]
+	}
+	return strings.TrimSpace(selector), ""
+}
+
+// scrapeSelection finds the selector within the item, an empty selector is the item itself.
+func scrapeSelection(element *goquery.Selection, selector string) *goquery.Selection {
+	if selector == "" {
+		return element
+	}
+	return element.Find(selector)
+}
+
+// scrapeValue returns the attribute (or defaultAttribute, if the element has it) or the text of
+// the first element matching selector.
+func scrapeValue(element *goquery.Selection, selector string, defaultAttribute string) string {
+	selector, attribute := splitScrapeSelector(selector)
+	selection := scrapeSelection(element, selector).First()
+
+	if attribute != "" {
+		value, _ := selection.Attr(attribute)
+		return value
+	}
+
+	if defaultAttribute != "" {
+		if value, ok := selection.Attr(defaultAttribute); ok {
+			return value
+		}
+	}
+
+	return selection.Text()
+}
+
+// scrapeHTML returns the HTML of every element matching selector, or the attribute if one is given.
+func scrapeHTML(element *goquery.Selection, selector string) string {
+	selector, attribute := splitScrapeSelector(selector)
+	selection := scrapeSelection(element, selector)
+
+	if attribute != "" {
+		value, _ := selection.First().Attr(attribute)
+		return value
+	}
+
+	var content strings.Builder
+	selection.Each(func(_ int, matched *goquery.Selection) {
+		html, err := goquery.OuterHtml(matched)
+		if err == nil {
+			content.WriteString(html)
+		}
+	})
+
+	return strings.TrimSpace(content.String())
+}
+
+func resolveItemURL(base *url.URL, value string) string {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return ""
+	}
+
+	resolved, err := base.Parse(value)
+	if err != nil {
+		return value
+	}
+	return resolved.String()
+}
+
+func parseItemDate(value string, layout string, location *time.Location) (time.Time, error) {
+	if layout != "" {
+		return time.ParseInLocation(layout, value, location)
+	}
+
+	for _, layout := range itemDateLayouts {
+		if parsed, err := time.ParseInLocation(layout, value, location); err == nil {
+			return parsed, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("unrecognized date %q, set date_format", value)
+}
+
+func (o ScrapeOptions) validate(field string, issues *ValidationError) (ok bool) {
+	ok = true
+
+	if o.Item == "" {
+		issues.AddIssue(field+".item", "item is required")
+		ok = false
+	} else if _, err := cascadia.ParseGroup(o.Item); err != nil {
+		issues.AddIssue(field+".item", fmt.Sprintf("invalid selector: %s", err.Error()))
+		ok = false
+	}
+
+	if o.Title == "" {
+		issues.AddIssue(field+".title", "title is required")
+		ok = false
+	}
+
+	selectors := []struct {
+		name     string
+		selector string
+	}{
+		{"title", o.Title},
+		{"link", o.Link},
+		{"date", o.Date},
+		{"content", o.Content},
+		{"image", o.Image},
+	}
+	for _, s := range selectors {
+		selector, _ := splitScrapeSelector(s.selector)
+		if selector == "" {
+			continue
+		}
+		if _, err := cascadia.ParseGroup(selector); err != nil {
+			issues.AddIssue(field+"."+s.name, fmt.Sprintf("invalid selector: %s", err.Error()))
+			ok = false
+		}
+	}
+
+	if o.DateFormat != "" && o.Date == "" {
+		issues.AddIssue(field+".date_format", "date_format requires date")
+		ok = false
+	}
+
+	if o.TimeZone != "" {
+		if _, err := time.LoadLocation(o.TimeZone); err != nil {
+			issues.AddIssue(field+".time_zone", fmt.Sprintf("unknown time zone %q", o.TimeZone))
+			ok = false
+		}
+	}
+
+	return ok
+}
@@ -0,0 +1,204 @@
+// Copyright 2024 Teknologi Umum <opensource@teknologiumum.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package brassite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+// DefaultScriptTimeout is how long a script may run for a single item when ScriptHook.Timeout is empty.
+const DefaultScriptTimeout = time.Second
+
+// Compiled scripts, keyed by their path, or their source code for inline scripts.
+var scriptPrograms sync.Map
+
+// scriptItem is the item as seen by the script. Only the fields listed in
+// applyScriptItem are copied back, the rest are informative.
+type scriptItem struct {
+	FeedName   string   `json:"feed_name"`
+	GUID       string   `json:"guid"`
+	Title      string   `json:"title"`
+	Content    string   `json:"content"`
+	URL        string   `json:"url"`
+	Image      string   `json:"image"`
+	Categories []string `json:"categories"`
+	Authors    []string `json:"authors"`
+	Published  string   `json:"published"`
+}
+
+// IsEnabled returns true if a script is configured.
+func (s ScriptHook) IsEnabled() bool {
+	return s.Path != "" || s.Source != ""
+}
+
+// Compile reads and compiles the script, it's cached so Run doesn't compile it again. Script
+// files are only read once, changes are picked up on restart.
+func (s ScriptHook) Compile() (*goja.Program, error) {
+	key := "source:" + s.Source
+	if s.Path != "" {
+		key = "path:" + s.Path
+	}
+
+	if program, ok := scriptPrograms.Load(key); ok {
+		return program.(*goja.Program), nil
+	}
+
+	source := s.Source
+	name := "script.js"
+	if s.Path != "" {
+		content, err := os.ReadFile(s.Path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read script: %w", err)
+		}
+		source = string(content)
+		name = s.Path
+	}
+
+	program, err := goja.Compile(name, source, true)
+	if err != nil {
+		return nil, err
+	}
+
+	scriptPrograms.Store(key, program)
+	return program, nil
+}
+
+// Run calls the `transform(item)` function of the script with the feed item. The script may
+// change the item and return it, or return null to drop it. keep is false if the item was dropped.
+func (s ScriptHook) Run(ctx context.Context, feedItem FeedItem) (result FeedItem, keep bool, err error) {
+	program, err := s.Compile()
+	if err != nil {
+		return feedItem, false, fmt.Errorf("failed to compile script: %w", err)
+	}
+
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = DefaultScriptTimeout
+	}
+
+	runtime := goja.New()
+	runtime.SetFieldNameMapper(goja.TagFieldNameMapper("json", true))
+
+	// A script stuck in a loop is interrupted once it runs out of time (or the context is done),
+	// so a single bad item can't stall the whole feed.
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() {
+		runtime.Interrupt(ctx.Err())
+	})
+	defer stop()
+
+	if _, err := runtime.RunProgram(program); err != nil {
+		return feedItem, false, scriptError(err)
+	}
+
+	transform, ok := goja.AssertFunction(runtime.Get("transform"))
+	if !ok {
+		return feedItem, false, errors.New("script does not define a transform(item) function")
+	}
+
+	item := runtime.NewObject()
+	for key, value := range scriptItemFields(feedItem) {
+		if err := item.Set(key, value); err != nil {
+			return feedItem, false, fmt.Errorf("failed to set item.%s: %w", key, err)
+		}
+	}
+
+	value, err := transform(goja.Undefined(), item)
+	if err != nil {
+		return feedItem, false, scriptError(err)
+	}
+
+	if goja.IsNull(value) {
+		return feedItem, false, nil
+	}
+
+	// Returning nothing keeps the item, including the changes made to it.
+	if goja.IsUndefined(value) {
+		value = item
+	}
+
+	// Fields missing from a returned object keep their original value.
+	changed := scriptItem{
+		Title:      feedItem.ItemTitle,
+		Content:    feedItem.ItemDescription,
+		URL:        feedItem.ItemURL,
+		Image:      feedItem.ItemImage,
+		Categories: feedItem.ItemCategories,
+		Authors:    feedItem.ItemAuthors,
+	}
+	if err := runtime.ExportTo(value, &changed); err != nil {
+		return feedItem, false, fmt.Errorf("script returned an invalid item: %w", err)
+	}
+
+	return applyScriptItem(feedItem, changed), true, nil
+}
+
+func scriptItemFields(feedItem FeedItem) map[string]any {
+	published := ""
+	if !feedItem.ItemPublished.IsZero() {
+		published = feedItem.ItemPublished.Format(time.RFC3339)
+	}
+
+	categories := make([]any, 0, len(feedItem.ItemCategories))
+	for _, category := range feedItem.ItemCategories {
+		categories = append(categories, category)
+	}
+
+	authors := make([]any, 0, len(feedItem.ItemAuthors))
+	for _, author := range feedItem.ItemAuthors {
+		authors = append(authors, author)
+	}
+
+	return map[string]any{
+		"feed_name":  feedItem.FeedName,
+		"guid":       feedItem.ItemGUID,
+		"title":      feedItem.ItemTitle,
+		"content":    feedItem.ItemDescription,
+		"url":        feedItem.ItemURL,
+		"image":      feedItem.ItemImage,
+		"categories": categories,
+		"authors":    authors,
+		"published":  published,
+	}
+}
+
+// applyScriptItem copies the fields the script is allowed to change. The GUID is left alone,
+// it's what we use to recognize the item later on.
+func applyScriptItem(feedItem FeedItem, changed scriptItem) FeedItem {
+	feedItem.ItemTitle = changed.Title
+	feedItem.ItemDescription = changed.Content
+	feedItem.ItemURL = changed.URL
+	feedItem.ItemImage = changed.Image
+	feedItem.ItemCategories = changed.Categories
+	feedItem.ItemAuthors = changed.Authors
+	return feedItem
+}
+
+func scriptError(err error) error {
+	var interrupted *goja.InterruptedError
+	if errors.As(err, &interrupted) {
+		return fmt.Errorf("script was interrupted: %v", interrupted.Value())
+	}
+
+	return fmt.Errorf("script failed: %w", err)
+}
@@ -0,0 +1,319 @@
+// Copyright 2024 Teknologi Umum <opensource@teknologiumum.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package brassite
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/mmcdole/gofeed"
+	ext "github.com/mmcdole/gofeed/extensions"
+)
+
+// Platforms with a shorthand instead of a feed URL.
+const (
+	PlatformYouTube  = "youtube"
+	PlatformReddit   = "reddit"
+	PlatformMastodon = "mastodon"
+)
+
+// RedditUserAgent is sent to Reddit, which throttles generic user agents to the point of being unusable.
+const RedditUserAgent = "Brassite/1.0 (+https://github.com/teknologi-umum/brassite)"
+
+var (
+	youtubeHandlePattern   = regexp.MustCompile(`^@[A-Za-z0-9_.-]{3,30}$`)
+	youtubeChannelPattern  = regexp.MustCompile(`^UC[A-Za-z0-9_-]{22}$`)
+	youtubePlaylistPattern = regexp.MustCompile(`^(PL|UU|LL|FL|OL)[A-Za-z0-9_-]{10,}$`)
+	redditNamePattern      = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	mastodonPattern        = regexp.MustCompile(`^([@#])([^@\s]+)@([^@\s/]+)$`)
+	mastodonUserPattern    = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+)
+
+var redditSorts = map[string]bool{"hot": true, "new": true, "top": true, "rising": true, "controversial": true}
+
+var redditTimeRanges = map[string]bool{"hour": true, "day": true, "week": true, "month": true, "year": true, "all": true}
+
+// Platform returns the platform of the shorthand the feed uses, or an empty string if it uses a URL.
+func (f Feed) Platform() string {
+	switch {
+	case f.YouTube != "":
+		return PlatformYouTube
+	case f.Reddit != "":
+		return PlatformReddit
+	case f.Mastodon != "":
+		return PlatformMastodon
+	}
+	return ""
+}
+
+// ShorthandURL expands the YouTube, Reddit, or Mastodon shorthand of the feed to its feed URL.
+// YouTube handles expand to the channel page, the channel's feed is then discovered on it.
+func (f Feed) ShorthandURL() (string, error) {
+	switch f.Platform() {
+	case PlatformYouTube:
+		return youtubeFeedURL(strings.TrimSpace(f.YouTube))
+	case PlatformReddit:
+		return redditFeedURL(f.Reddit)
+	case PlatformMastodon:
+		return mastodonFeedURL(strings.TrimSpace(f.Mastodon))
+	}
+	return "", nil
+}
+
+// expandShorthand fills the URL (and the headers the platform needs) from the shorthand.
+func (f *Feed) expandShorthand() error {
+	if f.Platform() == "" {
+		return nil
+	}
+
+	shorthandURL, err := f.ShorthandURL()
+	if err != nil {
+		return err
+	}
+
+	if f.URL == "" {
+		f.URL = shorthandURL
+	}
+
+	if f.Platform() == PlatformReddit && !hasHeader(f.Headers, "User-Agent") {
+		headers := make(map[string]string, len(f.Headers)+1)
+		for key, value := range f.Headers {
+			headers[key] = value
+		}
+		headers["User-Agent"] = RedditUserAgent
+		f.Headers = headers
+	}
+
+	return nil
+}
+
+func (f Feed) validateShorthand(field string, issues *ValidationError) (ok bool) {
+	ok = true
+
+	shorthands := 0
+	for _, shorthand := range []string{f.YouTube, f.Reddit, f.Mastodon} {
+		if shorthand != "" {
+			shorthands++
+		}
+	}
+	if shorthands > 1 {
+		issues.AddIssue(field, "only one of youtube, reddit, or mastodon can be used")
+		ok = false
+	}
+
+	if f.Type != "" && f.Type != SourceTypeFeed {
+		issues.AddIssue(field+".type", fmt.Sprintf("%s can't be used with type %s", f.Platform(), f.Type))
+		ok = false
+	}
+
+	shorthandURL, err := f.ShorthandURL()
+	if err != nil {
+		issues.AddIssue(field+"."+f.Platform(), err.Error())
+		return false
+	}
+
+	if f.URL != "" && f.URL != shorthandURL {
+		issues.AddIssue(field+".url", fmt.Sprintf("url can't be used together with %s", f.Platform()))
+		ok = false
+	}
+
+	return ok
+}
+
+func youtubeFeedURL(value string) (string, error) {
+	switch {
+	case youtubeHandlePattern.MatchString(value):
+		return "https://www.youtube.com/" + value, nil
+	case youtubeChannelPattern.MatchString(value):
+		return "https://www.youtube.com/feeds/videos.xml?channel_id=" + value, nil
+	case youtubePlaylistPattern.MatchString(value):
+		return "https://www.youtube.com/feeds/videos.xml?playlist_id=" + value, nil
+	}
+	return "", errors.New("youtube must be an @handle, a channel ID (UC...), or a playlist ID (PL...)")
+}
+
+// redditFeedURL expands `r/<subreddit>` or `u/<user>`, optionally followed by `sort=<sort>`
+// and `t=<time range>` for the top and controversial sorts.
+func redditFeedURL(value string) (string, error) {
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return "", errors.New("reddit must be r/<subreddit> or u/<user>")
+	}
+
+	kind, name, found := strings.Cut(strings.TrimPrefix(fields[0], "/"), "/")
+	name = strings.TrimSuffix(name, "/")
+	if !found || !redditNamePattern.MatchString(name) || (kind != "r" && kind != "u" && kind != "user") {
+		return "", errors.New("reddit must be r/<subreddit> or u/<user>")
+	}
+
+	sort, timeRange := "", ""
+	for _, option := range fields[1:] {
+		key, value, _ := strings.Cut(option, "=")
+		switch key {
+		case "sort":
+			if !redditSorts[value] {
+				return "", fmt.Errorf("unknown reddit sort %q, must be one of hot, new, top, rising, or controversial", value)
+			}
+			sort = value
+		case "t":
+			if !redditTimeRanges[value] {
+				return "", fmt.Errorf("unknown reddit time range %q, must be one of hour, day, week, month, year, or all", value)
+			}
+			timeRange = value
+		default:
+			return "", fmt.Errorf("unknown reddit option %q, must be sort or t", option)
+		}
+	}
+
+	if timeRange != "" && sort != "top" && sort != "controversial" {
+		return "", errors.New("reddit time range only applies to sort=top and sort=controversial")
+	}
+
+	query := url.Values{}
+	var feedURL string
+	if kind == "r" {
+		feedURL = "https://www.reddit.com/r/" + name + "/"
+		if sort != "" && sort != "hot" {
+			feedURL += sort + "/"
+		}
+	} else {
+		// User listings take the sort as a parameter instead.
+		feedURL = "https://www.reddit.com/user/" + name + "/submitted/"
+		if sort != "" {
+			query.Set("sort", sort)
+		}
+	}
+	feedURL += ".rss"
+
+	if timeRange != "" {
+		query.Set("t", timeRange)
+	}
+	if len(query) > 0 {
+		feedURL += "?" + query.Encode()
+	}
+
+	return feedURL, nil
+}
+
+// mastodonFeedURL expands `@user@instance` or `#tag@instance`.
+func mastodonFeedURL(value string) (string, error) {
+	matches := mastodonPattern.FindStringSubmatch(value)
+	if matches == nil {
+		return "", errors.New("mastodon must be @user@instance or #tag@instance")
+	}
+
+	// The instance is a host name, with an optional port, anything else would change the URL.
+	instance, err := url.Parse("https://" + matches[3])
+	if err != nil || instance.Host != matches[3] || instance.Hostname() == "" || instance.User != nil ||
+		instance.Path != "" || instance.RawQuery != "" || instance.ForceQuery || instance.Fragment != "" {
+		return "", errors.New("mastodon instance must be a host name, with an optional port")
+	}
+
+	if matches[1] == "#" {
+		return "https://" + matches[3] + "/tags/" + url.PathEscape(matches[2]) + ".rss", nil
+	}
+	if !mastodonUserPattern.MatchString(matches[2]) {
+		return "", errors.New("mastodon user names only contain letters, digits, and underscores")
+	}
+	return "https://" + matches[3] + "/@" + matches[2] + ".rss", nil
+}
+
+// MapPlatformMedia fills the items of feeds using a shorthand with the media the platform
+// provides through Media RSS: the thumbnail as the item image, the video description of YouTube
+// items, and the videos and audios attached to Mastodon posts.
+func MapPlatformMedia(feed Feed, remoteFeed *gofeed.Feed) {
+	platform := feed.Platform()
+	if platform == "" || remoteFeed == nil {
+		return
+	}
+
+	for _, item := range remoteFeed.Items {
+		media := item.Extensions["media"]
+
+		if item.Image == nil || item.Image.URL == "" {
+			if image := mediaImage(media); image != "" {
+				item.Image = &gofeed.Image{URL: image}
+			}
+		}
+
+		switch platform {
+		case PlatformYouTube:
+			if item.Description == "" && item.Content == "" {
+				if description := mediaValue(media, "description"); description != "" {
+					item.Description = "<p>" + strings.ReplaceAll(html.EscapeString(description), "\n", "<br>") + "</p>"
+				}
+			}
+
+		case PlatformMastodon:
+			for _, content := range mediaElements(media, "content") {
+				mediaURL := content.Attrs["url"]
+				medium := content.Attrs["medium"]
+				if mediaURL == "" || (medium != "video" && medium != "audio") {
+					continue
+				}
+
+				item.Enclosures = append(item.Enclosures, &gofeed.Enclosure{URL: mediaURL, Type: content.Attrs["type"]})
+				item.Description += fmt.Sprintf(`<p><a href="%s">%s</a></p>`, html.EscapeString(mediaURL), medium)
+			}
+		}
+	}
+}
+
+// mediaElements returns the Media RSS elements with the name, directly in the item or in a media:group.
+func mediaElements(media map[string][]ext.Extension, name string) []ext.Extension {
+	elements := append([]ext.Extension{}, media[name]...)
+	for _, group := range media["group"] {
+		elements = append(elements, group.Children[name]...)
+	}
+	return elements
+}
+
+func mediaValue(media map[string][]ext.Extension, name string) string {
+	for _, element := range mediaElements(media, name) {
+		if value := strings.TrimSpace(element.Value); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func mediaImage(media map[string][]ext.Extension) string {
+	for _, thumbnail := range mediaElements(media, "thumbnail") {
+		if thumbnail.Attrs["url"] != "" {
+			return thumbnail.Attrs["url"]
+		}
+	}
+
+	for _, content := range mediaElements(media, "content") {
+		if content.Attrs["url"] != "" && (content.Attrs["medium"] == "image" || strings.HasPrefix(content.Attrs["type"], "image/")) {
+			return content.Attrs["url"]
+		}
+	}
+
+	return ""
+}
+
+func hasHeader(headers map[string]string, name string) bool {
+	for key := range headers {
+		if strings.EqualFold(key, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,277 @@
+// Copyright 2024 Teknologi Umum <opensource@teknologiumum.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package brassite
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// StateStore is a small persistent key-value store, kept in memory and written as a single
+// JSON file on every change. Keys are grouped in buckets, one per feature, so they don't clash.
+// It's meant for the few thousand records brassite needs to remember, not for anything big.
+type StateStore struct {
+	path string
+
+	mu      sync.Mutex
+	buckets map[string]map[string]stateEntry
+	// fileInfo of the state file when we last read or wrote it, used to notice when
+	// another process (e.g. the `brassite dlq` command) replaced it.
+	fileInfo os.FileInfo
+}
+
+type stateEntry struct {
+	Value     json.RawMessage `json:"value"`
+	ExpiresAt *time.Time      `json:"expires_at,omitempty"`
+}
+
+func (e stateEntry) expired(now time.Time) bool {
+	return e.ExpiresAt != nil && now.After(*e.ExpiresAt)
+}
+
+// OpenStateStore loads the state from path. An empty path gives an in-memory store,
+// which works the same but forgets everything on restart.
+func OpenStateStore(path string) (*StateStore, error) {
+	store := &StateStore{
+		path:    path,
+		buckets: make(map[string]map[string]stateEntry),
+	}
+
+	if path == "" {
+		return store, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return store, nil
+		}
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+
+	if len(content) == 0 {
+		return store, nil
+	}
+
+	err = json.Unmarshal(content, &store.buckets)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode state file: %w", err)
+	}
+
+	if info, err := os.Stat(path); err == nil {
+		store.fileInfo = info
+	}
+
+	return store, nil
+}
+
+// lockFile holds the state file for a reload, change, and save, so another process writing to
+// it in the meantime isn't overwritten. Must hold s.mu.
+func (s *StateStore) lockFile() (unlock func(), err error) {
+	if s.path == "" {
+		return func() {}, nil
+	}
+	return lockStateFile(s.path)
+}
+
+// reload reads the state file again if another process replaced it since we last
+// touched it. Must hold s.mu.
+func (s *StateStore) reload() error {
+	if s.path == "" {
+		return nil
+	}
+
+	info, err := os.Stat(s.path)
+	// Every save renames a new file over the old one, comparing the files themselves catches
+	// the changes made within the resolution of the modification time.
+	if err != nil || (s.fileInfo != nil && os.SameFile(info, s.fileInfo) && info.ModTime().Equal(s.fileInfo.ModTime())) {
+		return nil
+	}
+
+	content, err := os.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to read state file: %w", err)
+	}
+
+	buckets := make(map[string]map[string]stateEntry)
+	if len(content) > 0 {
+		err = json.Unmarshal(content, &buckets)
+		if err != nil {
+			return fmt.Errorf("failed to decode state file: %w", err)
+		}
+	}
+
+	s.buckets = buckets
+	s.fileInfo = info
+	return nil
+}
+
+// Get decodes the value of key into out, it returns false if the key doesn't exist or expired.
+func (s *StateStore) Get(bucket string, key string, out any) (bool, error) {
+	s.mu.Lock()
+	err := s.reload()
+	entry, ok := s.buckets[bucket][key]
+	s.mu.Unlock()
+
+	if err != nil {
+		return false, err
+	}
+
+	if !ok || entry.expired(time.Now()) {
+		return false, nil
+	}
+
+	err = json.Unmarshal(entry.Value, out)
+	if err != nil {
+		return false, fmt.Errorf("failed to decode state %s/%s: %w", bucket, key, err)
+	}
+
+	return true, nil
+}
+
+// Put stores the value of key. A positive ttl makes the key expire, zero keeps it forever.
+func (s *StateStore) Put(bucket string, key string, value any, ttl time.Duration) error {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to encode state %s/%s: %w", bucket, key, err)
+	}
+
+	entry := stateEntry{Value: encoded}
+	if ttl > 0 {
+		expiresAt := time.Now().Add(ttl).UTC()
+		entry.ExpiresAt = &expiresAt
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := s.lockFile()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := s.reload(); err != nil {
+		return err
+	}
+
+	if s.buckets[bucket] == nil {
+		s.buckets[bucket] = make(map[string]stateEntry)
+	}
+	s.buckets[bucket][key] = entry
+
+	return s.save()
+}
+
+// Delete removes the key, deleting a key that doesn't exist is not an error.
+func (s *StateStore) Delete(bucket string, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := s.lockFile()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := s.reload(); err != nil {
+		return err
+	}
+
+	if _, ok := s.buckets[bucket][key]; !ok {
+		return nil
+	}
+
+	delete(s.buckets[bucket], key)
+	return s.save()
+}
+
+// Keys returns the keys of the bucket that haven't expired, sorted.
+func (s *StateStore) Keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// A failed reload keeps what we have in memory, which is still the best we know.
+	_ = s.reload()
+
+	now := time.Now()
+	keys := make([]string, 0, len(s.buckets[bucket]))
+	for key, entry := range s.buckets[bucket] {
+		if !entry.expired(now) {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// save drops the expired entries, in memory as well, and writes the whole state to a temporary
+// file, then renames it over the old one so a crash in the middle of a write never leaves a
+// corrupted state file. Must hold s.mu.
+func (s *StateStore) save() error {
+	now := time.Now()
+	for _, entries := range s.buckets {
+		for key, entry := range entries {
+			if entry.expired(now) {
+				delete(entries, key)
+			}
+		}
+	}
+
+	if s.path == "" {
+		return nil
+	}
+
+	content, err := json.Marshal(s.buckets)
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %w", err)
+	}
+
+	temporary, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary state file: %w", err)
+	}
+
+	_, err = temporary.Write(content)
+	if err == nil {
+		err = temporary.Sync()
+	}
+	if closeErr := temporary.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(temporary.Name())
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+
+	err = os.Rename(temporary.Name(), s.path)
+	if err != nil {
+		_ = os.Remove(temporary.Name())
+		return fmt.Errorf("failed to replace state file: %w", err)
+	}
+
+	if info, err := os.Stat(s.path); err == nil {
+		s.fileInfo = info
+	}
+
+	return nil
+}
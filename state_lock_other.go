@@ -0,0 +1,23 @@
+// Copyright 2024 Teknologi Umum <opensource@teknologiumum.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !unix
+
+package brassite
+
+// lockStateFile does nothing where flock isn't available, don't run `brassite dlq retry` or
+// `purge` while the daemon is writing to the same state file there.
+func lockStateFile(string) (unlock func(), err error) {
+	return func() {}, nil
+}
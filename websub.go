@@ -0,0 +1,419 @@
+// Copyright 2024 Teknologi Umum <opensource@teknologiumum.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package brassite
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+	"github.com/mmcdole/gofeed/atom"
+)
+
+const webSubBucket = "websub"
+
+// WebSubCallbackPath is where the built-in server receives WebSub verifications and notifications.
+const WebSubCallbackPath = "/websub/"
+
+const (
+	// Lease we ask the hub for, hubs are free to grant a different one.
+	webSubLease = 7 * 24 * time.Hour
+	// A subscription that wasn't verified after this long is considered failed.
+	webSubVerificationTimeout = time.Hour
+	// Pushed content bigger than this is ignored.
+	webSubMaxContentSize = 10 << 20
+)
+
+// WebSubSubscription is a subscription to a feed's hub, kept in the state store.
+type WebSubSubscription struct {
+	FeedName string `json:"feed_name"`
+	Hub      string `json:"hub"`
+	Topic    string `json:"topic"`
+	// Secret signs the notifications, see X-Hub-Signature
+	Secret string `json:"secret"`
+	// CallbackID is the last segment of the callback URL
+	CallbackID  string    `json:"callback_id"`
+	RequestedAt time.Time `json:"requested_at"`
+	VerifiedAt  time.Time `json:"verified_at,omitempty"`
+	ExpiresAt   time.Time `json:"expires_at,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// WebSubSubscriber subscribes to WebSub hubs and receives their notifications on
+// WebSubCallbackPath. It's an http.Handler, meant to be mounted on the built-in server.
+type WebSubSubscriber struct {
+	state     *StateStore
+	publicURL string
+	onContent func(feedName string, contentType string, body []byte)
+
+	// Subscriptions are read, changed, and written back, it must not interleave.
+	mu sync.Mutex
+}
+
+// NewWebSubSubscriber creates a subscriber whose callbacks live under publicURL. onContent is
+// called in its own goroutine for every valid notification, so the hub gets its answer right away.
+func NewWebSubSubscriber(state *StateStore, publicURL string, onContent func(feedName string, contentType string, body []byte)) *WebSubSubscriber {
+	return &WebSubSubscriber{
+		state:     state,
+		publicURL: strings.TrimSuffix(publicURL, "/"),
+		onContent: onContent,
+	}
+}
+
+// DiscoverWebSub finds the hub and the topic (the "self" link) advertised by the feed, either in
+// the HTTP Link header or in the feed itself. hub is empty if the feed doesn't support WebSub.
+func DiscoverWebSub(header http.Header, body []byte, feed *gofeed.Feed) (hub string, topic string) {
+	for _, value := range header.Values("Link") {
+		for _, link := range strings.Split(value, ",") {
+			target, params, found := strings.Cut(link, ";")
+			if !found {
+				continue
+			}
+			target = strings.Trim(strings.TrimSpace(target), "<>")
+			for _, rel := range linkRels(params) {
+				switch {
+				case rel == "hub" && hub == "":
+					hub = target
+				case rel == "self" && topic == "":
+					topic = target
+				}
+			}
+		}
+	}
+
+	if feed != nil {
+		// RSS feeds advertise them with <atom:link rel="hub" href="..."/>.
+		for _, link := range feed.Extensions["atom"]["link"] {
+			switch {
+			case link.Attrs["rel"] == "hub" && hub == "":
+				hub = link.Attrs["href"]
+			case link.Attrs["rel"] == "self" && topic == "":
+				topic = link.Attrs["href"]
+			}
+		}
+
+		// gofeed drops the rel of Atom links, parse it again to get them.
+		if feed.FeedType == "atom" {
+			atomParser := &atom.Parser{}
+			if atomFeed, err := atomParser.Parse(bytes.NewReader(body)); err == nil {
+				for _, link := range atomFeed.Links {
+					switch {
+					case link.Rel == "hub" && hub == "":
+						hub = link.Href
+					case link.Rel == "self" && topic == "":
+						topic = link.Href
+					}
+				}
+			}
+		}
+	}
+
+	return hub, topic
+}
+
+func linkRels(params string) []string {
+	for _, param := range strings.Split(params, ";") {
+		name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		if strings.EqualFold(name, "rel") {
+			return strings.Fields(strings.Trim(value, `"`))
+		}
+	}
+	return nil
+}
+
+// Subscription returns the subscription of the feed, if there's one.
+func (s *WebSubSubscriber) Subscription(feedName string) (WebSubSubscription, bool) {
+	if s == nil {
+		return WebSubSubscription{}, false
+	}
+
+	var subscription WebSubSubscription
+	found, err := s.state.Get(webSubBucket, feedName, &subscription)
+	if err != nil || !found {
+		return WebSubSubscription{}, false
+	}
+	return subscription, true
+}
+
+// IsActive returns true if the hub verified the subscription and its lease is not over, the
+// feed doesn't need to be polled then.
+func (s *WebSubSubscriber) IsActive(feedName string, now time.Time) bool {
+	subscription, ok := s.Subscription(feedName)
+	return ok && !subscription.VerifiedAt.IsZero() && subscription.ExpiresAt.After(now)
+}
+
+// NeedsSubscription returns true if the feed should (re)subscribe to the hub: it never did, the
+// hub or topic changed, the hub never verified the last attempt, or the lease is almost over.
+func (s *WebSubSubscriber) NeedsSubscription(feedName string, hub string, topic string, now time.Time) bool {
+	subscription, ok := s.Subscription(feedName)
+	if !ok || subscription.Hub != hub || subscription.Topic != topic {
+		return true
+	}
+
+	// Give the hub some time to verify the last request before asking again.
+	if subscription.RequestedAt.After(subscription.VerifiedAt) && now.Sub(subscription.RequestedAt) < webSubVerificationTimeout {
+		return false
+	}
+
+	if subscription.VerifiedAt.IsZero() {
+		return true
+	}
+
+	// Renew once a fifth of the lease is left.
+	lease := subscription.ExpiresAt.Sub(subscription.VerifiedAt)
+	return subscription.ExpiresAt.Sub(now) < lease/5
+}
+
+// Subscribe asks the hub to send the topic's updates to our callback. The hub verifies the
+// subscription later on by calling the callback, see ServeHTTP. Only HTTPS hubs are accepted,
+// the secret signing the notifications can't be sent in the clear.
+func (s *WebSubSubscriber) Subscribe(ctx context.Context, feedName string, hub string, topic string) error {
+	if !isHTTPSURL(hub) {
+		return fmt.Errorf("websub hub %s doesn't use https", hub)
+	}
+
+	s.mu.Lock()
+	subscription, ok := s.Subscription(feedName)
+	if !ok || subscription.Hub != hub || subscription.Topic != topic {
+		callbackID, err := randomHex(16)
+		if err != nil {
+			s.mu.Unlock()
+			return fmt.Errorf("failed to generate websub callback: %w", err)
+		}
+		secret, err := randomHex(32)
+		if err != nil {
+			s.mu.Unlock()
+			return fmt.Errorf("failed to generate websub secret: %w", err)
+		}
+		subscription = WebSubSubscription{FeedName: feedName, Hub: hub, Topic: topic, CallbackID: callbackID, Secret: secret}
+	}
+	// Renewals keep the callback, the secret, and the current lease until the hub verifies the new one.
+	subscription.RequestedAt = time.Now()
+	subscription.LastError = ""
+	err := s.state.Put(webSubBucket, feedName, subscription, 0)
+	s.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to save websub subscription: %w", err)
+	}
+
+	form := url.Values{
+		"hub.mode":          {"subscribe"},
+		"hub.topic":         {topic},
+		"hub.callback":      {s.publicURL + WebSubCallbackPath + subscription.CallbackID},
+		"hub.secret":        {subscription.Secret},
+		"hub.lease_seconds": {strconv.Itoa(int(webSubLease.Seconds()))},
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, hub, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("failed to create websub request: %w", err)
+	}
+
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("User-Agent", "Brassite/1.0")
+
+	response, err := HTTPClientFromContext(ctx).Do(request)
+	if err != nil {
+		return fmt.Errorf("failed to send websub subscription: %w", err)
+	}
+	defer func() {
+		if response.Body != nil {
+			_ = response.Body.Close()
+		}
+	}()
+
+	if response.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("websub hub responded with %d (%s)", response.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
+
+// ServeHTTP answers the hub's verification requests (GET) and receives its notifications (POST).
+func (s *WebSubSubscriber) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	callbackID := strings.TrimPrefix(r.URL.Path, WebSubCallbackPath)
+	subscription, ok := s.findByCallback(callbackID)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.verify(w, r, subscription)
+	case http.MethodPost:
+		s.receive(w, r, subscription)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *WebSubSubscriber) verify(w http.ResponseWriter, r *http.Request, subscription WebSubSubscription) {
+	query := r.URL.Query()
+	switch query.Get("hub.mode") {
+	case "subscribe":
+		if query.Get("hub.topic") != subscription.Topic {
+			http.NotFound(w, r)
+			return
+		}
+
+		lease := webSubLease
+		if seconds, err := strconv.Atoi(query.Get("hub.lease_seconds")); err == nil && seconds > 0 {
+			lease = time.Duration(seconds) * time.Second
+		}
+
+		now := time.Now()
+		err := s.update(subscription.FeedName, func(subscription *WebSubSubscription) {
+			subscription.VerifiedAt = now
+			subscription.ExpiresAt = now.Add(lease)
+			subscription.LastError = ""
+		})
+		if err != nil {
+			http.Error(w, "failed to save subscription", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = io.WriteString(w, query.Get("hub.challenge"))
+	case "denied":
+		_ = s.update(subscription.FeedName, func(subscription *WebSubSubscription) {
+			subscription.VerifiedAt = time.Time{}
+			subscription.ExpiresAt = time.Time{}
+			subscription.LastError = "denied by hub: " + query.Get("hub.reason")
+		})
+		w.WriteHeader(http.StatusOK)
+	default:
+		// We never unsubscribe, so an unsubscribe request is not ours.
+		http.NotFound(w, r)
+	}
+}
+
+func (s *WebSubSubscriber) receive(w http.ResponseWriter, r *http.Request, subscription WebSubSubscription) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, webSubMaxContentSize+1))
+	if err != nil {
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+
+	if len(body) > webSubMaxContentSize {
+		http.Error(w, "body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// The spec asks for a 2xx response even if the signature is wrong, the content is ignored.
+	w.WriteHeader(http.StatusAccepted)
+
+	// Subscriptions saved before plain HTTP hubs were refused may still be around.
+	if !isHTTPSURL(subscription.Hub) || !validWebSubSignature(r.Header.Get("X-Hub-Signature"), subscription.Secret, body) {
+		return
+	}
+
+	if s.onContent != nil {
+		go s.onContent(subscription.FeedName, r.Header.Get("Content-Type"), body)
+	}
+}
+
+func (s *WebSubSubscriber) findByCallback(callbackID string) (WebSubSubscription, bool) {
+	if callbackID == "" {
+		return WebSubSubscription{}, false
+	}
+
+	for _, feedName := range s.state.Keys(webSubBucket) {
+		subscription, ok := s.Subscription(feedName)
+		if ok && hmac.Equal([]byte(subscription.CallbackID), []byte(callbackID)) {
+			return subscription, true
+		}
+	}
+	return WebSubSubscription{}, false
+}
+
+func (s *WebSubSubscriber) update(feedName string, change func(subscription *WebSubSubscription)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	subscription, ok := s.Subscription(feedName)
+	if !ok {
+		return fmt.Errorf("websub subscription for %s not found", feedName)
+	}
+
+	change(&subscription)
+	return s.state.Put(webSubBucket, feedName, subscription, 0)
+}
+
+// validWebSubSignature checks the X-Hub-Signature header, e.g. "sha256=<hex HMAC of the body>".
+// Unsigned notifications are never valid.
+func validWebSubSignature(header string, secret string, body []byte) bool {
+	if secret == "" {
+		return false
+	}
+
+	method, signature, found := strings.Cut(header, "=")
+	if !found {
+		return false
+	}
+
+	var newHash func() hash.Hash
+	switch strings.ToLower(method) {
+	case "sha1":
+		newHash = sha1.New
+	case "sha256":
+		newHash = sha256.New
+	case "sha384":
+		newHash = sha512.New384
+	case "sha512":
+		newHash = sha512.New
+	default:
+		return false
+	}
+
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(newHash, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+func isHTTPSURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && strings.EqualFold(u.Scheme, "https") && u.Host != ""
+}
+
+func randomHex(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}